@@ -2,32 +2,108 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 
+	"mailcleanerpro/internal/config"
 	"mailcleanerpro/internal/handler"
+	"mailcleanerpro/internal/jobs"
+	"mailcleanerpro/internal/journal"
 	"mailcleanerpro/internal/middleware"
+	"mailcleanerpro/internal/retention"
 	"mailcleanerpro/internal/service"
+	"mailcleanerpro/internal/session"
 	"mailcleanerpro/pkg/auth"
 	"mailcleanerpro/pkg/gmail"
 	"mailcleanerpro/pkg/logger"
 )
 
-func generateStateOauthCookie(c *gin.Context) string {
-	b := make([]byte, 32)
-	_, err := rand.Read(b)
+// sessionFromRequest returns the request's signed-in session. It writes a 401
+// response and returns false if there is none.
+func sessionFromRequest(c *gin.Context, sessions *session.Store) (*session.Session, bool) {
+	sess, err := sessions.FromRequest(c.Request)
+	if err != nil || sess.Token == nil {
+		sessions.ClearCookie(c.Writer)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "not signed in",
+			"message": "Please sign in with your Gmail account",
+			"action":  "reauth_required",
+		})
+		return nil, false
+	}
+	return sess, true
+}
+
+// gmailServiceFromRequest builds a Gmail client from the OAuth token of the
+// request's session. It writes an error response and returns false if that is
+// not possible.
+func gmailServiceFromRequest(c *gin.Context, gmailConfig *gmail.Config, sessions *session.Store) (*gmail.Service, bool) {
+	sess, ok := sessionFromRequest(c, sessions)
+	if !ok {
+		return nil, false
+	}
+	conf, err := auth.NewGoogleOAuth2Config()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	// Background jobs outlive the request, so the token source must not use
+	// its context. Refreshed tokens are saved back to the session.
+	ts := auth.TokenSource(context.Background(), conf, sess.Token,
+		func(t *oauth2.Token) error { return sessions.SetToken(sess.ID, t) },
+		func(err error) {
+			logger.L().Warn("Failed to save refreshed OAuth token",
+				zap.String("user_id", sess.UserID),
+				zap.Error(err),
+			)
+		},
+	)
+	httpClient := option.WithHTTPClient(oauth2.NewClient(context.Background(), ts))
+	// The session already names the account, so no profile lookup is needed.
+	config := *gmailConfig
+	config.Account = sess.Email
+	gsvc, err := gmail.NewService(c, httpClient, &config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	gsvc.SetAccess(auth.AccessForScopes(sess.Scopes))
+	return gsvc, true
+}
+
+// openTokenStore opens the encrypted token store and re-encrypts tokens
+// sealed with a rotated-out key. It returns nil if no encryption key is
+// configured, in which case tokens are only kept in memory.
+func openTokenStore(cfg *config.TokenStoreConfig) (auth.TokenStore, error) {
+	if cfg.EncryptionKeys == "" {
+		logger.L().Warn("TOKEN_ENCRYPTION_KEYS is not set; OAuth tokens are kept in memory only")
+		return nil, nil
+	}
+	keys, err := auth.ParseKeyring(cfg.EncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOKEN_ENCRYPTION_KEYS: %w", err)
+	}
+	store, err := auth.OpenTokenStore(cfg.Backend, cfg.Path, keys)
 	if err != nil {
-		// fallback to timestamp if random fails (not recommended, but avoids crash)
-		return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d", time.Now().UnixNano())))
+		return nil, fmt.Errorf("failed to open token store: %w", err)
+	}
+	n, err := store.Rotate(context.Background())
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to rotate token encryption key: %w", err)
+	}
+	if n > 0 {
+		logger.L().Info("Re-encrypted OAuth tokens with the primary key", zap.Int("token_count", n))
 	}
-	return base64.URLEncoding.EncodeToString(b)
+	return store, nil
 }
 
 func setupRouter() (*gin.Engine, error) {
@@ -42,6 +118,48 @@ func setupRouter() (*gin.Engine, error) {
 		return nil, fmt.Errorf("failed to initialize logger: %w", err)
 	}
 
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	retry := gmail.DefaultRetryConfig()
+	retry.MaxAttempts = cfg.Gmail.RetryMaxAttempts
+	retry.InitialBackoff = cfg.Gmail.RetryInitialBackoff
+	retry.MaxBackoff = cfg.Gmail.RetryMaxBackoff
+	gmailConfig := &gmail.Config{
+		Retry: retry,
+		// One limiter for the whole server, so concurrent requests for the
+		// same account share its quota budget.
+		Limiter: gmail.NewLimiter(&gmail.RateLimitConfig{
+			UserUnitsPerSecond:    cfg.Gmail.QuotaUserUnitsPerSecond,
+			ProjectUnitsPerSecond: cfg.Gmail.QuotaProjectUnitsPerSecond,
+		}),
+	}
+
+	protection := &service.Protection{
+		Labels:  cfg.Cleanup.ProtectedLabels,
+		Senders: cfg.Cleanup.ProtectedSenders,
+	}
+
+	tokens, err := openTokenStore(&cfg.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	sessions := session.NewStore(&session.Config{
+		TTL:          cfg.Session.TTL,
+		CookieSecure: cfg.Session.CookieSecure,
+		Tokens:       tokens,
+	})
+
+	journalStore, err := journal.NewStore(cfg.Cleanup.JournalDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open undo journal: %w", err)
+	}
+	newCleaner := func(gsvc *gmail.Service) *service.CleanerService {
+		return service.NewCleanerService(gsvc, protection, journalStore, cfg.Cleanup.BackupDir)
+	}
+
 	// Create Gin engine without default middleware
 	r := gin.New()
 
@@ -68,6 +186,15 @@ func setupRouter() (*gin.Engine, error) {
 		c.Next()
 	})
 
+	loginFlow, err := auth.NewLoginFlow(&auth.LoginFlowConfig{
+		Secret:            []byte(cfg.Session.StateSecret),
+		CookieSecure:      cfg.Session.CookieSecure,
+		ReturnToAllowlist: cfg.Session.ReturnToAllowlist,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid login configuration: %w", err)
+	}
+
 	// UI
 	r.GET("/", func(c *gin.Context) {
 		c.File("web/templates/index.html")
@@ -80,28 +207,45 @@ func setupRouter() (*gin.Engine, error) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		state := generateStateOauthCookie(c)
-		// Set state in a secure cookie
-		http.SetCookie(c.Writer, &http.Cookie{
-			Name:     "oauthstate",
-			Value:    state,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteLaxMode,
-		})
-		url := conf.AuthCodeURL(state, oauth2.AccessTypeOffline)
+		// The scope profile defaults to modify; ask for full access only to
+		// delete permanently. Scopes granted earlier are kept, so asking for
+		// more later is an incremental authorization.
+		access := auth.DefaultAccess
+		if scope := c.Query("scope"); scope != "" {
+			if access, err = gmail.ParseAccess(scope); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		conf.Scopes = auth.ScopesForAccess(access)
+
+		// Google only returns a refresh token when the user is shown the
+		// consent screen, and the session needs one to outlive the hour-long
+		// access token.
+		url, err := loginFlow.Begin(c.Writer, conf, c.Query("return_to"),
+			oauth2.AccessTypeOffline, oauth2.ApprovalForce,
+			oauth2.SetAuthURLParam("include_granted_scopes", "true"),
+		)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, auth.ErrReturnToNotAllowed) {
+				status = http.StatusBadRequest
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
 		c.Redirect(http.StatusTemporaryRedirect, url)
 	})
 
 	r.GET("/auth/callback", func(c *gin.Context) {
-		// Debug: Log all query parameters
-		fmt.Printf("Callback received with query params: %v\n", c.Request.URL.RawQuery)
+		// The query carries the authorization code and state, so it is
+		// never logged.
+		log := logger.L().With(zap.String("client_ip", c.ClientIP()))
 
-		// Validate state to prevent CSRF
-		stateFromQuery := c.Query("state")
-		cookie, err := c.Request.Cookie("oauthstate")
-		if err != nil || cookie.Value != stateFromQuery {
+		// Validate state to prevent CSRF; the state cookie is consumed here.
+		login, err := loginFlow.Complete(c.Writer, c.Request)
+		if err != nil {
+			log.Warn("Rejected OAuth callback with invalid state")
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
 			return
 		}
@@ -124,10 +268,10 @@ func setupRouter() (*gin.Engine, error) {
 
 		code := c.Query("code")
 		if code == "" {
+			log.Warn("OAuth callback without authorization code", zap.String("oauth_error", c.Query("error")))
 			errorMsg := gin.H{
-				"error":           "missing code",
-				"received_params": c.Request.URL.Query(),
-				"help":            "This endpoint should be called by Google OAuth after user authorization. Please start the flow at /auth/login",
+				"error": "missing code",
+				"help":  "This endpoint should be called by Google OAuth after user authorization. Please start the flow at /auth/login",
 			}
 			if isFetchRequest {
 				c.JSON(http.StatusBadRequest, errorMsg)
@@ -139,9 +283,20 @@ func setupRouter() (*gin.Engine, error) {
 		}
 
 		// Exchange code for token and get user info
-		authResponse, err := auth.ExchangeCodeWithUserInfo(c, conf, code)
+		authResponse, err := auth.ExchangeCodeWithUserInfo(c, conf, code, oauth2.VerifierOption(login.Verifier))
+		if err == nil {
+			var claims *auth.IDTokenClaims
+			claims, err = auth.VerifyIDToken(authResponse.Token, conf.ClientID, login.Nonce)
+			if err == nil && claims.Subject != authResponse.UserInfo.ID {
+				err = fmt.Errorf("%w: issued for another user", auth.ErrInvalidIDToken)
+			}
+			// Jobs, journals and policies are owned by the email address.
+			if err == nil && authResponse.UserInfo.Email == "" {
+				err = errors.New("google did not return the account's email address")
+			}
+		}
 		if err != nil {
-			fmt.Printf("Error during token exchange: %v\n", err)
+			log.Warn("OAuth token exchange failed", zap.Error(err))
 			if isFetchRequest {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			} else {
@@ -150,127 +305,150 @@ func setupRouter() (*gin.Engine, error) {
 			return
 		}
 
-		fmt.Printf("Successfully authenticated user: %s\n", authResponse.UserInfo.Email)
+		log.Info("User signed in", zap.String("user_id", authResponse.UserInfo.ID))
+
+		// Keep the token on the server; the browser only gets the session cookie.
+		sessionID, sess, err := sessions.Create(authResponse.UserInfo, authResponse.Token)
+		if err != nil {
+			if isFetchRequest {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			} else {
+				c.Redirect(http.StatusTemporaryRedirect, "/?error=server_error")
+			}
+			return
+		}
+		sessions.SetCookie(c.Writer, sessionID)
 
-		// If it's a fetch request from frontend, return JSON
 		if isFetchRequest {
 			c.JSON(http.StatusOK, gin.H{
-				"access_token":  authResponse.AccessToken,
-				"refresh_token": authResponse.RefreshToken,
-				"user_email":    authResponse.UserInfo.Email,
-				"user_name":     authResponse.UserInfo.Name,
-				"user_picture":  authResponse.UserInfo.Picture,
-				"expires_in":    authResponse.ExpiresIn,
+				"user_id":    sess.UserID,
+				"email":      sess.Email,
+				"name":       sess.Name,
+				"picture":    sess.Picture,
+				"scopes":     sess.Scopes,
+				"created_at": sess.CreatedAt,
+				"expires_at": sess.ExpiresAt,
+				"return_to":  login.ReturnTo,
 			})
 			return
 		}
-
-		// For direct browser navigation, serve HTML with embedded data for frontend to pick up
-		htmlResponse := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Authentication Success - Gmail Cleaner Pro</title>
-    <style>
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
-            display: flex;
-            justify-content: center;
-            align-items: center;
-            min-height: 100vh;
-            margin: 0;
-            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
-            color: white;
-        }
-        .container {
-            text-align: center;
-            background: rgba(255, 255, 255, 0.1);
-            padding: 2rem;
-            border-radius: 10px;
-            backdrop-filter: blur(10px);
-        }
-        .spinner {
-            border: 3px solid rgba(255, 255, 255, 0.3);
-            border-top: 3px solid white;
-            border-radius: 50%%;
-            width: 40px;
-            height: 40px;
-            animation: spin 1s linear infinite;
-            margin: 20px auto;
-        }
-        @keyframes spin {
-            0%% { transform: rotate(0deg); }
-            100%% { transform: rotate(360deg); }
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h2>🎉 Authentication Successful!</h2>
-        <p>Welcome, %s!</p>
-        <div class="spinner"></div>
-        <p>Redirecting you to the application...</p>
-    </div>
-    <script>
-        // Store authentication data in localStorage
-        localStorage.setItem('gmail_access_token', '%s');
-        localStorage.setItem('user_email', '%s');
-        localStorage.setItem('user_name', '%s');
-        localStorage.setItem('user_picture', '%s');
-        localStorage.setItem('auth_expires_in', '%d');
-        localStorage.setItem('auth_timestamp', Date.now().toString());
-        
-        // Redirect to home page after a brief delay
-        setTimeout(() => {
-            window.location.href = '/';
-        }, 2000);
-    </script>
-</body>
-</html>`,
-			authResponse.UserInfo.Name,
-			authResponse.AccessToken,
-			authResponse.UserInfo.Email,
-			authResponse.UserInfo.Name,
-			authResponse.UserInfo.Picture,
-			authResponse.ExpiresIn,
-		)
-
-		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(htmlResponse))
+		c.Redirect(http.StatusSeeOther, login.ReturnTo)
 	})
 
-	// Gmail service injection per request using provided token
+	sessionHandler := handler.NewSessionHandler(sessions, journalStore, cfg.Session.RevokeURL)
+	r.POST("/auth/logout", sessionHandler.Logout)
+	r.POST("/auth/revoke", sessionHandler.Revoke)
+	r.GET("/api/v1/me", sessionHandler.Me)
+
+	// Gmail service injection per request using the session's token
 	r.POST("/api/v1/clean", func(c *gin.Context) {
-		accessToken := c.GetHeader("X-Access-Token")
-		if accessToken == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":   "missing X-Access-Token",
-				"message": "Please re-authenticate with your Gmail account",
-				"action":  "reauth_required",
-			})
-			return
-		}
-		conf, err := auth.NewGoogleOAuth2Config()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		gsvc, ok := gmailServiceFromRequest(c, gmailConfig, sessions)
+		if !ok {
 			return
 		}
+		cleaner := newCleaner(gsvc)
+		h := handler.NewCleanHandler(cleaner)
+		h.Clean(c)
+	})
+
+	// Background cleanup jobs
+	jobManager := jobs.NewManager(jobs.DefaultRetention)
+	jobHandler := handler.NewJobHandler(jobManager)
 
-		// Create token with proper configuration
-		t := &oauth2.Token{
-			AccessToken: accessToken,
-			TokenType:   "Bearer",
+	// Jobs belong to the account of the session that started them.
+	withSession := func(h func(*gin.Context, *session.Session)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if sess, ok := sessionFromRequest(c, sessions); ok {
+				h(c, sess)
+			}
 		}
+	}
+	withSessionGmail := func(h func(*gin.Context, *session.Session, *gmail.Service)) gin.HandlerFunc {
+		return withSession(func(c *gin.Context, sess *session.Session) {
+			if gsvc, ok := gmailServiceFromRequest(c, gmailConfig, sessions); ok {
+				h(c, sess, gsvc)
+			}
+		})
+	}
 
-		httpClient := option.WithHTTPClient(conf.Client(context.Background(), t))
-		gsvc, err := gmail.NewService(c, httpClient)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+	r.POST("/api/v1/jobs", withSessionGmail(func(c *gin.Context, sess *session.Session, gsvc *gmail.Service) {
+		jobHandler.Create(c, sess.Owner(), newCleaner(gsvc))
+	}))
+	r.GET("/api/v1/jobs/:id", withSession(func(c *gin.Context, sess *session.Session) {
+		jobHandler.Get(c, sess.Owner())
+	}))
+	r.DELETE("/api/v1/jobs/:id", withSession(func(c *gin.Context, sess *session.Session) {
+		jobHandler.Cancel(c, sess.Owner())
+	}))
+	r.GET("/api/v1/jobs/:id/events", withSession(func(c *gin.Context, sess *session.Session) {
+		jobHandler.Events(c, sess.Owner())
+	}))
+	r.POST("/api/v1/jobs/:id/undo", withSessionGmail(func(c *gin.Context, sess *session.Session, gsvc *gmail.Service) {
+		jobHandler.Undo(c, sess.Owner(), newCleaner(gsvc))
+	}))
+
+	// Saved retention policies, run as background jobs
+	retentionStore, err := retention.NewStore(cfg.Cleanup.RetentionPoliciesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open retention policy store: %w", err)
+	}
+	retentionHandler := handler.NewRetentionHandler(retentionStore, jobManager)
+	withGmail := func(h func(*gin.Context, *gmail.Service)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if gsvc, ok := gmailServiceFromRequest(c, gmailConfig, sessions); ok {
+				h(c, gsvc)
+			}
 		}
-		cleaner := service.NewCleanerService(gsvc)
-		h := handler.NewCleanHandler(cleaner)
-		h.Clean(c)
-	})
+	}
+
+	// Policies are local records of the session's account; only running one
+	// needs Gmail.
+	r.GET("/api/v1/retention-policies", withSession(func(c *gin.Context, sess *session.Session) {
+		retentionHandler.List(c, sess.Owner())
+	}))
+	r.POST("/api/v1/retention-policies", withSession(func(c *gin.Context, sess *session.Session) {
+		retentionHandler.Create(c, sess.Owner())
+	}))
+	r.GET("/api/v1/retention-policies/:id", withSession(func(c *gin.Context, sess *session.Session) {
+		retentionHandler.Get(c, sess.Owner())
+	}))
+	r.PUT("/api/v1/retention-policies/:id", withSession(func(c *gin.Context, sess *session.Session) {
+		retentionHandler.Update(c, sess.Owner())
+	}))
+	r.DELETE("/api/v1/retention-policies/:id", withSession(func(c *gin.Context, sess *session.Session) {
+		retentionHandler.Delete(c, sess.Owner())
+	}))
+	r.POST("/api/v1/retention-policies/:id/run", withSessionGmail(func(c *gin.Context, sess *session.Session, gsvc *gmail.Service) {
+		retentionHandler.Run(c, sess.Owner(), newCleaner(gsvc))
+	}))
+
+	// Mailbox analytics
+	analyticsHandler := handler.NewAnalyticsHandler()
+	r.GET("/api/v1/analytics", withGmail(analyticsHandler.Get))
+
+	// Large attachments
+	attachmentHandler := handler.NewAttachmentHandler(jobManager)
+	r.GET("/api/v1/attachments/large", withGmail(func(c *gin.Context, gsvc *gmail.Service) {
+		attachmentHandler.Large(c, newCleaner(gsvc))
+	}))
+	r.POST("/api/v1/attachments/large/clean", withSessionGmail(func(c *gin.Context, sess *session.Session, gsvc *gmail.Service) {
+		attachmentHandler.Clean(c, sess.Owner(), newCleaner(gsvc))
+	}))
+
+	// Duplicate messages
+	dedupHandler := handler.NewDedupHandler(jobManager)
+	r.POST("/api/v1/dedup", withSessionGmail(func(c *gin.Context, sess *session.Session, gsvc *gmail.Service) {
+		dedupHandler.Dedup(c, sess.Owner(), newCleaner(gsvc))
+	}))
+
+	// Newsletters
+	newsletterHandler := handler.NewNewsletterHandler()
+	r.GET("/api/v1/newsletters", withGmail(func(c *gin.Context, gsvc *gmail.Service) {
+		newsletterHandler.List(c, service.NewNewsletterService(gsvc, nil))
+	}))
+	r.POST("/api/v1/newsletters/unsubscribe", withGmail(func(c *gin.Context, gsvc *gmail.Service) {
+		newsletterHandler.Unsubscribe(c, service.NewNewsletterService(gsvc, newCleaner(gsvc)))
+	}))
 
 	// Health check endpoints
 	r.GET("/health", func(c *gin.Context) {
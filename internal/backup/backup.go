@@ -0,0 +1,265 @@
+// Package backup writes raw messages to mbox files or EML directories, and
+// attachments to plain directories, so that mail can be kept before it is
+// deleted.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Format is the on-disk layout of a backup.
+type Format string
+
+const (
+	// FormatMbox appends every message to a single mboxrd file.
+	FormatMbox Format = "mbox"
+	// FormatEML writes every message to its own .eml file in a directory.
+	FormatEML Format = "eml"
+)
+
+// DefaultDir is where backups are written when no directory is configured.
+const DefaultDir = "data/backups"
+
+// Options configures a backup.
+type Options struct {
+	Format Format
+	// Dir is the directory backups are created in.
+	Dir string
+	// Gzip compresses the mbox file, or each EML file.
+	Gzip bool
+}
+
+// Archive receives the messages of one backup.
+type Archive interface {
+	// Add writes a message in RFC 2822 form, received at date.
+	Add(messageID string, date time.Time, raw []byte) error
+	// Path is the file or directory the backup is written to.
+	Path() string
+	Close() error
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// Create starts a backup named name in opts.Dir.
+func Create(opts Options, name string) (Archive, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid backup name %q", name)
+	}
+	dir := opts.Dir
+	if dir == "" {
+		dir = DefaultDir
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create backup directory: %w", err)
+	}
+
+	switch opts.Format {
+	case FormatMbox, "":
+		return createMbox(filepath.Join(dir, name+".mbox"), opts.Gzip)
+	case FormatEML:
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(path, 0o700); err != nil {
+			return nil, fmt.Errorf("create backup directory: %w", err)
+		}
+		return &emlArchive{dir: path, gzip: opts.Gzip}, nil
+	default:
+		return nil, fmt.Errorf("unknown backup format %q", opts.Format)
+	}
+}
+
+// mboxArchive writes messages to a single mboxrd file.
+type mboxArchive struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	w    *bufio.Writer
+}
+
+func createMbox(path string, compress bool) (*mboxArchive, error) {
+	if compress {
+		path += ".gz"
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create mbox: %w", err)
+	}
+	a := &mboxArchive{path: path, file: f}
+	var w io.Writer = f
+	if compress {
+		a.gz = gzip.NewWriter(f)
+		w = a.gz
+	}
+	a.w = bufio.NewWriter(w)
+	return a, nil
+}
+
+func (a *mboxArchive) Path() string { return a.path }
+
+// Add appends raw as an mboxrd message: a "From " separator line, the message
+// with line endings normalised to LF and "From " lines quoted, then a blank line.
+func (a *mboxArchive) Add(messageID string, date time.Time, raw []byte) error {
+	fmt.Fprintf(a.w, "From MAILER-DAEMON %s\n", date.UTC().Format(time.ANSIC))
+
+	body := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			a.w.WriteByte('>')
+		}
+		a.w.Write(line)
+	}
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		a.w.WriteByte('\n')
+	}
+	if _, err := a.w.WriteString("\n"); err != nil {
+		return fmt.Errorf("write message %s to mbox: %w", messageID, err)
+	}
+	// Flush and sync per message so that a crash mid-run keeps everything
+	// written so far. Flushing gzip ends a deflate block, so the data
+	// decompresses even if the gzip trailer is never written.
+	if err := a.w.Flush(); err != nil {
+		return fmt.Errorf("write message %s to mbox: %w", messageID, err)
+	}
+	if a.gz != nil {
+		if err := a.gz.Flush(); err != nil {
+			return fmt.Errorf("write message %s to mbox: %w", messageID, err)
+		}
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("sync mbox after message %s: %w", messageID, err)
+	}
+	return nil
+}
+
+func (a *mboxArchive) Close() error {
+	err := a.w.Flush()
+	if a.gz != nil {
+		if cerr := a.gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("close mbox: %w", err)
+	}
+	return nil
+}
+
+// emlArchive writes each message to its own file.
+type emlArchive struct {
+	dir  string
+	gzip bool
+}
+
+func (a *emlArchive) Path() string { return a.dir }
+
+func (a *emlArchive) Add(messageID string, date time.Time, raw []byte) error {
+	name := safeFilename(messageID) + ".eml"
+	if a.gzip {
+		name += ".gz"
+	}
+	path := filepath.Join(a.dir, name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if a.gzip {
+		gz = gzip.NewWriter(f)
+		gz.ModTime = date
+		w = gz
+	}
+	_, err = w.Write(raw)
+	if gz != nil {
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	if !a.gzip {
+		// Keep the received date on the file for mail clients importing it.
+		os.Chtimes(path, date, date)
+	}
+	return nil
+}
+
+func (a *emlArchive) Close() error { return nil }
+
+// AttachmentDir saves attachments to a directory, one file per attachment.
+type AttachmentDir struct {
+	dir   string
+	names map[string]bool
+}
+
+// CreateAttachmentDir creates the directory name in opts.Dir for attachments.
+func CreateAttachmentDir(opts Options, name string) (*AttachmentDir, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid backup name %q", name)
+	}
+	dir := opts.Dir
+	if dir == "" {
+		dir = DefaultDir
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("create attachment directory: %w", err)
+	}
+	return &AttachmentDir{dir: path, names: make(map[string]bool)}, nil
+}
+
+// Path is the directory attachments are saved to.
+func (d *AttachmentDir) Path() string { return d.dir }
+
+// Add saves an attachment of messageID as "<messageID>_<filename>", adding a
+// counter when a message has several attachments of the same name.
+func (d *AttachmentDir) Add(messageID, filename string, data []byte) error {
+	base := safeFilename(messageID) + "_" + safeFilename(filename)
+	name := base
+	for i := 2; d.names[name]; i++ {
+		ext := filepath.Ext(base)
+		name = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(base, ext), i, ext)
+	}
+	d.names[name] = true
+
+	if err := os.WriteFile(filepath.Join(d.dir, name), data, 0o600); err != nil {
+		return fmt.Errorf("save attachment %s: %w", name, err)
+	}
+	return nil
+}
+
+// safeFilename reduces a name taken from a message to a single path element.
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == ".." || name == "" {
+		name = "attachment"
+	}
+	if len(name) > 200 {
+		name = name[len(name)-200:]
+	}
+	return name
+}
@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxAddIsReadableBeforeClose(t *testing.T) {
+	tests := []struct {
+		name string
+		gzip bool
+	}{
+		{"plain", false},
+		{"gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, err := Create(Options{Format: FormatMbox, Dir: t.TempDir(), Gzip: tt.gzip}, "run")
+			if err != nil {
+				t.Fatalf("Create() = %v", err)
+			}
+			defer archive.Close()
+
+			raw := "From: a@example.com\r\nSubject: hi\r\n\r\nFrom here on\r\n"
+			if err := archive.Add("m1", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), []byte(raw)); err != nil {
+				t.Fatalf("Add() = %v", err)
+			}
+
+			// Read what is on disk without closing the archive, as after a crash.
+			f, err := os.Open(archive.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var r io.Reader = f
+			if tt.gzip {
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatalf("gzip.NewReader() = %v", err)
+				}
+				r = gz
+			}
+			got, err := io.ReadAll(r)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatalf("reading mbox: %v", err)
+			}
+
+			want := "From MAILER-DAEMON Tue Jan  2 03:04:05 2024\n" +
+				"From: a@example.com\nSubject: hi\n\n>From here on\n\n"
+			if string(got) != want {
+				t.Errorf("mbox contents = %q, want %q", got, want)
+			}
+			if tt.gzip != strings.HasSuffix(archive.Path(), ".gz") {
+				t.Errorf("Path() = %q, gzip %v", archive.Path(), tt.gzip)
+			}
+		})
+	}
+}
@@ -3,10 +3,67 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type AppConfig struct {
-	Port string
+	Port    string
+	Gmail   GmailConfig
+	Cleanup CleanupConfig
+	Session SessionConfig
+	Tokens  TokenStoreConfig
+}
+
+// GmailConfig holds settings for the Gmail API client.
+type GmailConfig struct {
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	// QuotaUserUnitsPerSecond and QuotaProjectUnitsPerSecond are the quota-unit
+	// budgets of each account and of the whole OAuth client.
+	QuotaUserUnitsPerSecond    float64
+	QuotaProjectUnitsPerSecond float64
+}
+
+// CleanupConfig holds settings for cleanup runs.
+type CleanupConfig struct {
+	// ProtectedLabels and ProtectedSenders select threads that are never cleaned.
+	ProtectedLabels  []string
+	ProtectedSenders []string
+	// RetentionPoliciesPath is the JSON file saved retention policies are kept in.
+	RetentionPoliciesPath string
+	// JournalDir is the directory undo journals are written to.
+	JournalDir string
+	// BackupDir is the directory messages are backed up to before permanent
+	// deletion, and attachments are saved to.
+	BackupDir string
+}
+
+// SessionConfig holds settings for signed-in sessions.
+type SessionConfig struct {
+	TTL time.Duration
+	// CookieSecure restricts the session cookie to HTTPS.
+	CookieSecure bool
+	// RevokeURL is the OAuth token revocation endpoint; Google's when empty.
+	RevokeURL string
+	// StateSecret signs the cookies of logins in progress. A random secret
+	// is generated at startup when empty.
+	StateSecret string
+	// ReturnToAllowlist lists the absolute URL prefixes a login may return
+	// to. Paths on this server are always allowed.
+	ReturnToAllowlist []string
+}
+
+// TokenStoreConfig holds settings for the encrypted OAuth token store.
+type TokenStoreConfig struct {
+	// Backend is "file" or "sqlite".
+	Backend string
+	Path    string
+	// EncryptionKeys are comma-separated "id:base64-key" pairs, primary key
+	// first. Tokens are only kept in memory when unset.
+	EncryptionKeys string
 }
 
 func Load() (*AppConfig, error) {
@@ -14,7 +71,112 @@ func Load() (*AppConfig, error) {
 	if port == "" {
 		port = "8080"
 	}
-	return &AppConfig{Port: port}, nil
+
+	var err error
+	cfg := &AppConfig{Port: port}
+	if cfg.Gmail.RetryMaxAttempts, err = getEnvInt("GMAIL_RETRY_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if cfg.Gmail.RetryInitialBackoff, err = getEnvDuration("GMAIL_RETRY_INITIAL_BACKOFF", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.Gmail.RetryMaxBackoff, err = getEnvDuration("GMAIL_RETRY_MAX_BACKOFF", 32*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Gmail.QuotaUserUnitsPerSecond, err = getEnvFloat("GMAIL_QUOTA_USER_UNITS_PER_SECOND", 250); err != nil {
+		return nil, err
+	}
+	if cfg.Gmail.QuotaProjectUnitsPerSecond, err = getEnvFloat("GMAIL_QUOTA_PROJECT_UNITS_PER_SECOND", 20000); err != nil {
+		return nil, err
+	}
+	cfg.Cleanup.ProtectedLabels = getEnvList("PROTECTED_LABELS", []string{"STARRED", "IMPORTANT"})
+	cfg.Cleanup.ProtectedSenders = getEnvList("PROTECTED_SENDERS", nil)
+	cfg.Cleanup.RetentionPoliciesPath = os.Getenv("RETENTION_POLICIES_PATH")
+	cfg.Cleanup.JournalDir = os.Getenv("JOURNAL_DIR")
+	cfg.Cleanup.BackupDir = os.Getenv("BACKUP_DIR")
+	if cfg.Session.TTL, err = getEnvDuration("SESSION_TTL", 7*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.Session.CookieSecure, err = getEnvBool("SESSION_COOKIE_SECURE", true); err != nil {
+		return nil, err
+	}
+	cfg.Session.RevokeURL = os.Getenv("GOOGLE_REVOKE_URL")
+	cfg.Session.StateSecret = os.Getenv("OAUTH_STATE_SECRET")
+	cfg.Session.ReturnToAllowlist = getEnvList("OAUTH_RETURN_TO_ALLOWLIST", nil)
+	cfg.Tokens.Backend = os.Getenv("TOKEN_STORE_BACKEND")
+	cfg.Tokens.Path = os.Getenv("TOKEN_STORE_PATH")
+	cfg.Tokens.EncryptionKeys = os.Getenv("TOKEN_ENCRYPTION_KEYS")
+	return cfg, nil
 }
 
 func (c *AppConfig) Addr() string { return fmt.Sprintf(":%s", c.Port) }
+
+// getEnvList reads a comma-separated environment variable, returning def when
+// unset. Set the variable to an empty value to get an empty list.
+func getEnvList(key string, def []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvInt reads an integer environment variable, returning def when unset.
+func getEnvInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// getEnvBool reads a boolean environment variable such as "true" or "0",
+// returning def when unset.
+func getEnvBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// getEnvFloat reads a floating-point environment variable, returning def when unset.
+func getEnvFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// getEnvDuration reads a duration environment variable such as "500ms",
+// returning def when unset.
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"mailcleanerpro/internal/backup"
+	"mailcleanerpro/internal/jobs"
+	"mailcleanerpro/internal/rules"
+	"mailcleanerpro/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AttachmentHandler struct {
+	jobs *jobs.Manager
+}
+
+func NewAttachmentHandler(m *jobs.Manager) *AttachmentHandler {
+	return &AttachmentHandler{jobs: m}
+}
+
+// LargeAttachmentsRequest holds the query parameters of a large-attachment report.
+type LargeAttachmentsRequest struct {
+	MinSizeBytes int64  `form:"min_size_bytes" binding:"gte=0"`
+	Query        string `form:"query" binding:"max=2048"`
+	MaxThreads   int64  `form:"max_threads" binding:"gte=0,lte=10000"`
+}
+
+// LargeAttachmentCleanRequest cleans the threads a large-attachment report
+// with the same MinSizeBytes and Query would list. Action is "trash" (the
+// default) or "delete"; SaveAttachments keeps the attachments locally first.
+type LargeAttachmentCleanRequest struct {
+	MinSizeBytes    int64  `json:"min_size_bytes" binding:"gte=0"`
+	Query           string `json:"query" binding:"max=2048"`
+	MaxThreads      int64  `json:"max_threads" binding:"gte=0,lte=1000000"`
+	Action          string `json:"action" binding:"omitempty,oneof=trash delete"`
+	SaveAttachments bool   `json:"save_attachments"`
+	DryRun          bool   `json:"dry_run"`
+	SampleSize      int    `json:"sample_size" binding:"gte=0,lte=100"`
+	OnError         string `json:"on_error" binding:"omitempty,oneof=stop continue"`
+	Backup          string `json:"backup" binding:"omitempty,oneof=mbox eml"`
+	BackupGzip      bool   `json:"backup_gzip"`
+}
+
+// Large lists messages with attachments over a size threshold, largest first.
+func (h *AttachmentHandler) Large(c *gin.Context, cleaner *service.CleanerService) {
+	var req LargeAttachmentsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := cleaner.LargeAttachments(c, "me", &service.LargeAttachmentOptions{
+		MinSizeBytes: req.MinSizeBytes,
+		Query:        strings.TrimSpace(req.Query),
+		MaxThreads:   req.MaxThreads,
+	})
+	if err != nil {
+		writeGmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// Clean starts a background job, owned by the session user owner, that trashes
+// or deletes threads with large attachments, optionally saving the attachments
+// first. It responds with 202 Accepted and the job's ID.
+func (h *AttachmentHandler) Clean(c *gin.Context, owner string, cleaner *service.CleanerService) {
+	var req LargeAttachmentCleanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MinSizeBytes == 0 {
+		req.MinSizeBytes = service.DefaultLargeAttachmentSize
+	}
+	if req.MaxThreads == 0 {
+		req.MaxThreads = 1000000
+	}
+	action := rules.ActionTrash
+	if req.Action != "" {
+		action = rules.Action(req.Action)
+	}
+	var bk *backup.Options
+	if req.Backup != "" {
+		bk = &backup.Options{Format: backup.Format(req.Backup), Gzip: req.BackupGzip}
+	}
+
+	opts := &service.CleanOptions{
+		Query:           service.LargeAttachmentQuery(req.MinSizeBytes, strings.TrimSpace(req.Query)),
+		Action:          &rules.Operation{Action: action},
+		MaxPerCategory:  req.MaxThreads,
+		DryRun:          req.DryRun,
+		SampleSize:      req.SampleSize,
+		OnError:         service.ErrorPolicy(req.OnError),
+		Backup:          bk,
+		SaveAttachments: req.SaveAttachments,
+	}
+	if err := cleaner.CheckAccess(opts); err != nil {
+		writeGmailError(c, err)
+		return
+	}
+
+	info, err := h.jobs.Start(cleaner, "me", owner, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/api/v1/jobs/"+info.ID)
+	c.JSON(http.StatusAccepted, info)
+}
@@ -1,8 +1,12 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
+	"mailcleanerpro/internal/backup"
+	"mailcleanerpro/internal/rules"
 	"mailcleanerpro/internal/service"
 
 	"github.com/gin-gonic/gin"
@@ -16,48 +20,174 @@ func NewCleanHandler(s *service.CleanerService) *CleanHandler {
 	return &CleanHandler{cleaner: s}
 }
 
+// CleanRequest selects threads by category, by Gmail search query, or by both.
+// When both are given the query narrows down every category. Rules, if given,
+// decide per thread what happens to it; without categories or a query they
+// are evaluated against the whole mailbox.
 type CleanRequest struct {
-	MaxPerCategory int64    `json:"max_per_category" binding:"gte=0,lte=1000000"`
-	Categories     []string `json:"categories" binding:"required,min=1,dive,oneof=CATEGORY_SOCIAL CATEGORY_FORUMS CATEGORY_PROMOTIONS CATEGORY_UPDATES TRASH"`
+	MaxPerCategory int64        `json:"max_per_category" binding:"gte=0,lte=1000000"`
+	Categories     []string     `json:"categories" binding:"omitempty,dive,oneof=CATEGORY_SOCIAL CATEGORY_FORUMS CATEGORY_PROMOTIONS CATEGORY_UPDATES TRASH"`
+	Query          string       `json:"query" binding:"max=2048"`
+	Rules          []rules.Rule `json:"rules" binding:"omitempty,max=100"`
+	DryRun         bool         `json:"dry_run"`
+	SampleSize     int          `json:"sample_size" binding:"gte=0,lte=100"`
+	// OnError is "stop" (the default) or "continue".
+	OnError string `json:"on_error" binding:"omitempty,oneof=stop continue"`
+	// Action is applied to every selected thread. By default threads in TRASH
+	// are permanently deleted and everything else is moved to trash. LabelID
+	// is the destination of "move"; "label" adds and removes labels. Labels
+	// are given by ID or name.
+	Action       string   `json:"action" binding:"omitempty,oneof=trash delete archive mark_read label move"`
+	LabelID      string   `json:"label_id" binding:"max=256"`
+	AddLabels    []string `json:"add_labels" binding:"max=20"`
+	RemoveLabels []string `json:"remove_labels" binding:"max=20"`
+	// Backup saves threads as "mbox" or "eml" before they are permanently
+	// deleted, optionally gzip-compressed.
+	Backup     string `json:"backup" binding:"omitempty,oneof=mbox eml"`
+	BackupGzip bool   `json:"backup_gzip"`
+	// SaveAttachments saves the attachments of threads to BACKUP_DIR before
+	// they are trashed or deleted.
+	SaveAttachments bool `json:"save_attachments"`
 }
 
-type CleanResponse struct {
-	Deleted          map[string]int `json:"deleted"`
-	TotalDeleted     int            `json:"total_deleted"`
-	Completed        bool           `json:"completed"`
-	CompletionReason string         `json:"completion_reason"`
-}
-
-func (h *CleanHandler) Clean(c *gin.Context) {
+// bindCleanOptions parses a CleanRequest body into service options, writing a
+// 400 response and returning false if the request is invalid.
+func bindCleanOptions(c *gin.Context) (*service.CleanOptions, bool) {
 	var req CleanRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		return nil, false
+	}
+	req.Query = strings.TrimSpace(req.Query)
+	if len(req.Categories) == 0 && req.Query == "" && len(req.Rules) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "categories, query or rules are required"})
+		return nil, false
 	}
 	if req.MaxPerCategory == 0 {
 		req.MaxPerCategory = 1000000
 	}
 
-	summary, err := h.cleaner.CleanCategories(c, "me", req.Categories, req.MaxPerCategory)
+	var action *rules.Operation
+	if req.Action == "" && (req.LabelID != "" || len(req.AddLabels) > 0 || len(req.RemoveLabels) > 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "labels require an action of \"label\" or \"move\""})
+		return nil, false
+	}
+	if req.Action != "" {
+		if len(req.Rules) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "action cannot be combined with rules"})
+			return nil, false
+		}
+		action = &rules.Operation{
+			Action:       rules.Action(req.Action),
+			LabelID:      req.LabelID,
+			AddLabels:    req.AddLabels,
+			RemoveLabels: req.RemoveLabels,
+		}
+		if err := action.Validate(); err != nil {
+			msg := err.Error()
+			var verr *rules.ValidationError
+			if errors.As(err, &verr) {
+				msg = verr.Field + ": " + verr.Message
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg, "code": "invalid_action"})
+			return nil, false
+		}
+	}
+
+	var ruleSet *rules.Set
+	if len(req.Rules) > 0 {
+		var err error
+		if ruleSet, err = rules.Compile(req.Rules); err != nil {
+			body := gin.H{"error": err.Error(), "code": "invalid_rule"}
+			var verr *rules.ValidationError
+			if errors.As(err, &verr) {
+				body["rule"] = verr
+			}
+			c.JSON(http.StatusBadRequest, body)
+			return nil, false
+		}
+	}
+
+	var bk *backup.Options
+	if req.Backup != "" {
+		bk = &backup.Options{Format: backup.Format(req.Backup), Gzip: req.BackupGzip}
+	}
+
+	return &service.CleanOptions{
+		Categories:      req.Categories,
+		Query:           req.Query,
+		Rules:           ruleSet,
+		Action:          action,
+		MaxPerCategory:  req.MaxPerCategory,
+		DryRun:          req.DryRun,
+		SampleSize:      req.SampleSize,
+		OnError:         service.ErrorPolicy(req.OnError),
+		Backup:          bk,
+		SaveAttachments: req.SaveAttachments,
+	}, true
+}
+
+type CleanResponse struct {
+	Deleted          map[string]int                       `json:"deleted"`
+	TotalDeleted     int                                  `json:"total_deleted"`
+	TotalFailed      int                                  `json:"total_failed"`
+	TotalSkipped     int                                  `json:"total_skipped"`
+	TotalModified    int                                  `json:"total_modified"`
+	Results          map[string]*service.SelectionResult  `json:"results"`
+	Rules            map[string]*service.SelectionResult  `json:"rules,omitempty"`
+	Completed        bool                                 `json:"completed"`
+	CompletionReason string                               `json:"completion_reason"`
+	DryRun           bool                                 `json:"dry_run"`
+	Preview          map[string]*service.SelectionPreview `json:"preview,omitempty"`
+	Retries          int64                                `json:"retries"`
+	RunID            string                               `json:"run_id,omitempty"`
+	BackupPath       string                               `json:"backup_path,omitempty"`
+	AttachmentsPath  string                               `json:"attachments_path,omitempty"`
+	AttachmentsSaved int                                  `json:"attachments_saved,omitempty"`
+}
+
+func (h *CleanHandler) Clean(c *gin.Context) {
+	opts, ok := bindCleanOptions(c)
+	if !ok {
+		return
+	}
+
+	summary, err := h.cleaner.Clean(c, "me", opts)
+	writeCleanResult(c, summary, err)
+}
+
+// writeCleanResult writes the outcome of a synchronous cleanup run.
+func writeCleanResult(c *gin.Context, summary *service.CleanSummary, err error) {
 	if err != nil {
-		if service.IsAuthError(err) {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Authentication failed or insufficient permissions",
-				"suggestion": "Please re-authenticate with the required Gmail scopes",
-				"details": err.Error(),
-			})
-			return
+		status, body := gmailErrorResponse(c, err)
+		if summary != nil {
+			// Report what was already processed before the failure.
+			body["summary"] = newCleanResponse(summary)
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(status, body)
 		return
 	}
 
-	resp := &CleanResponse{
+	c.JSON(http.StatusOK, newCleanResponse(summary))
+}
+
+func newCleanResponse(summary *service.CleanSummary) *CleanResponse {
+	return &CleanResponse{
 		Deleted:          summary.PerCategoryDeleted,
 		TotalDeleted:     summary.TotalDeleted,
+		TotalFailed:      summary.TotalFailed,
+		TotalSkipped:     summary.TotalSkipped,
+		TotalModified:    summary.TotalModified,
+		Results:          summary.Results,
+		Rules:            summary.Rules,
 		Completed:        summary.Completed,
 		CompletionReason: summary.Reason,
+		DryRun:           summary.DryRun,
+		Preview:          summary.Preview,
+		Retries:          summary.Retries,
+		RunID:            summary.RunID,
+		BackupPath:       summary.BackupPath,
+		AttachmentsPath:  summary.AttachmentsPath,
+		AttachmentsSaved: summary.AttachmentsSaved,
 	}
-
-	c.JSON(http.StatusOK, resp)
 }
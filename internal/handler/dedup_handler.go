@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"mailcleanerpro/internal/jobs"
+	"mailcleanerpro/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DedupHandler struct {
+	jobs *jobs.Manager
+}
+
+func NewDedupHandler(m *jobs.Manager) *DedupHandler {
+	return &DedupHandler{jobs: m}
+}
+
+// DedupRequest searches the messages matching Query for duplicates. Keep is
+// "oldest" (the default) or "newest".
+type DedupRequest struct {
+	Query       string `json:"query" binding:"max=2048"`
+	MaxMessages int64  `json:"max_messages" binding:"gte=0,lte=50000"`
+	Keep        string `json:"keep" binding:"omitempty,oneof=oldest newest"`
+	DryRun      bool   `json:"dry_run"`
+	SampleSize  int    `json:"sample_size" binding:"gte=0,lte=100"`
+}
+
+// Dedup starts a background job, owned by the session user owner, that trashes
+// duplicate copies of messages, keeping one of each. It responds with 202
+// Accepted and the job's ID, which is also the run ID used to undo it.
+func (h *DedupHandler) Dedup(c *gin.Context, owner string, cleaner *service.CleanerService) {
+	var req DedupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts := &service.DedupOptions{
+		Query:       strings.TrimSpace(req.Query),
+		MaxMessages: req.MaxMessages,
+		Keep:        service.DedupKeep(req.Keep),
+		DryRun:      req.DryRun,
+		SampleSize:  req.SampleSize,
+	}
+	if err := cleaner.CheckDedupAccess(opts); err != nil {
+		writeGmailError(c, err)
+		return
+	}
+
+	info, err := h.jobs.StartDedup(cleaner, "me", owner, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/api/v1/jobs/"+info.ID)
+	c.JSON(http.StatusAccepted, info)
+}
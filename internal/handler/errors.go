@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"mailcleanerpro/pkg/gmail"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gmailErrorStatus maps Gmail error codes to the HTTP status returned to clients.
+var gmailErrorStatus = map[string]int{
+	gmail.CodeUnauthorized:      http.StatusUnauthorized,
+	gmail.CodeInsufficientScope: http.StatusForbidden,
+	gmail.CodeRateLimited:       http.StatusTooManyRequests,
+	gmail.CodeNotFound:          http.StatusNotFound,
+	gmail.CodeQuotaExceeded:     http.StatusServiceUnavailable,
+	gmail.CodeServerError:       http.StatusBadGateway,
+	gmail.CodeUnknownLabel:      http.StatusBadRequest,
+}
+
+// writeGmailError writes an error response for err. Gmail API failures get a
+// status and machine-readable "code" matching their kind; anything else is a
+// 500 with code "internal_error".
+func writeGmailError(c *gin.Context, err error) {
+	c.JSON(gmailErrorResponse(c, err))
+}
+
+// gmailErrorResponse returns the status and body writeGmailError would write
+// for err, setting any response headers on c.
+func gmailErrorResponse(c *gin.Context, err error) (int, gin.H) {
+	code := gmail.Code(err)
+	status, ok := gmailErrorStatus[code]
+	if !ok {
+		return http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  "internal_error",
+		}
+	}
+
+	body := gin.H{
+		"error": err.Error(),
+		"code":  code,
+	}
+	switch code {
+	case gmail.CodeUnauthorized:
+		body["suggestion"] = "Your Gmail session has expired or was revoked. Please re-authenticate."
+		body["action"] = "reauth_required"
+	case gmail.CodeInsufficientScope:
+		body["suggestion"] = "Please re-authenticate with the required Gmail scopes"
+		body["action"] = "reauth_required"
+		var accessErr *gmail.AccessError
+		if errors.As(err, &accessErr) {
+			body["required_scope"] = accessErr.Required.String()
+			body["reauth_url"] = "/auth/login?scope=" + accessErr.Required.String()
+		}
+	case gmail.CodeRateLimited, gmail.CodeQuotaExceeded:
+		var apiErr *gmail.APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			secs := int(math.Ceil(apiErr.RetryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(secs))
+			body["retry_after_seconds"] = secs
+		}
+	}
+	return status, body
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"mailcleanerpro/internal/jobs"
+	"mailcleanerpro/internal/journal"
+	"mailcleanerpro/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobHandler struct {
+	jobs *jobs.Manager
+}
+
+func NewJobHandler(m *jobs.Manager) *JobHandler {
+	return &JobHandler{jobs: m}
+}
+
+// Create starts a background cleanup job for the request body, owned by the
+// session user owner, and responds with 202 Accepted and the job's ID.
+func (h *JobHandler) Create(c *gin.Context, owner string, cleaner *service.CleanerService) {
+	opts, ok := bindCleanOptions(c)
+	if !ok {
+		return
+	}
+	if err := cleaner.CheckAccess(opts); err != nil {
+		writeGmailError(c, err)
+		return
+	}
+
+	info, err := h.jobs.Start(cleaner, "me", owner, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/api/v1/jobs/"+info.ID)
+	c.JSON(http.StatusAccepted, info)
+}
+
+// Get returns the status, progress and summary of one of owner's jobs. Other
+// users' jobs are reported as not found.
+func (h *JobHandler) Get(c *gin.Context, owner string) {
+	info, err := h.jobs.Get(c.Param("id"), owner)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// Cancel stops one of owner's running jobs.
+func (h *JobHandler) Cancel(c *gin.Context, owner string) {
+	info, err := h.jobs.Cancel(c.Param("id"), owner)
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, jobs.ErrFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "job": info})
+	default:
+		c.JSON(http.StatusOK, info)
+	}
+}
+
+// Undo reverts the changes made by a finished job, or by a synchronous
+// cleanup run whose run_id is given as the ID.
+func (h *JobHandler) Undo(c *gin.Context, owner string, cleaner *service.CleanerService) {
+	id := c.Param("id")
+	if info, err := h.jobs.Get(id, owner); err == nil && !info.Finished() {
+		c.JSON(http.StatusConflict, gin.H{"error": "job is still running; cancel it or wait for it to finish", "job": info})
+		return
+	}
+
+	summary, err := cleaner.Undo(c, "me", id)
+	switch {
+	case errors.Is(err, journal.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrJournalDisabled):
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+	case err != nil:
+		status, body := gmailErrorResponse(c, err)
+		if summary != nil {
+			body["summary"] = summary
+		}
+		c.JSON(status, body)
+	default:
+		c.JSON(http.StatusOK, summary)
+	}
+}
+
+// sseHeartbeat is how often a comment is sent on idle event streams so that
+// proxies do not close the connection.
+const sseHeartbeat = 15 * time.Second
+
+// Events streams the progress of one of owner's jobs as Server-Sent Events. Each progress event is
+// sent with its type as the event name; a final "status" event carries the
+// job's state once it finishes.
+func (h *JobHandler) Events(c *gin.Context, owner string) {
+	id := c.Param("id")
+	events, unsubscribe, err := h.jobs.Subscribe(id, owner)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if info, err := h.jobs.Get(id, owner); err == nil {
+		c.SSEvent("status", info)
+		c.Writer.Flush()
+	}
+	if events == nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": keep-alive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case e, ok := <-events:
+			if !ok {
+				if info, err := h.jobs.Get(id, owner); err == nil {
+					c.SSEvent("status", info)
+					c.Writer.Flush()
+				}
+				return
+			}
+			c.SSEvent(string(e.Type), e)
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"mailcleanerpro/internal/rules"
+	"mailcleanerpro/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type NewsletterHandler struct{}
+
+func NewNewsletterHandler() *NewsletterHandler {
+	return &NewsletterHandler{}
+}
+
+// NewslettersRequest holds the query parameters of a newsletter listing.
+type NewslettersRequest struct {
+	Query string `form:"query" binding:"max=2048"`
+	// MaxMessages is capped at 5000 because the listing is built while the
+	// request waits, fetching the metadata of each message in turn.
+	MaxMessages int64 `form:"max_messages" binding:"gte=0,lte=5000"`
+}
+
+// UnsubscribeRequest unsubscribes from the newsletter ID, as returned by
+// List. With Clean set, the newsletter's existing threads are then cleaned
+// with Action, which defaults to trash.
+type UnsubscribeRequest struct {
+	ID     string `json:"id" binding:"required,max=255"`
+	Method string `json:"method" binding:"omitempty,oneof=one_click mailto"`
+	Clean  bool   `json:"clean"`
+	Action string `json:"action" binding:"omitempty,oneof=trash archive mark_read"`
+}
+
+// List returns the newsletters found in recent mail with their volume and
+// supported unsubscribe methods.
+func (h *NewsletterHandler) List(c *gin.Context, newsletters *service.NewsletterService) {
+	var req NewslettersRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := newsletters.Newsletters(c, "me", &service.NewsletterOptions{
+		Query:       strings.TrimSpace(req.Query),
+		MaxMessages: req.MaxMessages,
+	})
+	if err != nil {
+		writeGmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// Unsubscribe unsubscribes from a newsletter and optionally cleans its threads.
+func (h *NewsletterHandler) Unsubscribe(c *gin.Context, newsletters *service.NewsletterService) {
+	var req UnsubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts := &service.UnsubscribeOptions{
+		ID:     strings.ToLower(strings.TrimSpace(req.ID)),
+		Method: service.UnsubscribeMethod(req.Method),
+	}
+	if req.Clean {
+		opts.Clean = &service.CleanOptions{
+			MaxPerCategory: 1000000,
+			OnError:        service.ErrorPolicyContinue,
+		}
+		if req.Action != "" {
+			opts.Clean.Action = &rules.Operation{Action: rules.Action(req.Action)}
+		}
+	}
+
+	result, err := newsletters.Unsubscribe(c, "me", opts)
+	switch {
+	case errors.Is(err, service.ErrNewsletterNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "code": "not_found"})
+	case errors.Is(err, service.ErrNoUnsubscribeMethod):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "unsubscribe_unavailable"})
+	case errors.Is(err, service.ErrUnsubscribeFailed):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "code": "unsubscribe_failed"})
+	case err != nil:
+		status, body := gmailErrorResponse(c, err)
+		if result != nil {
+			// The unsubscribe went through; only cleaning failed.
+			body["result"] = result
+		}
+		c.JSON(status, body)
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
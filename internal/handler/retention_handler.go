@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"mailcleanerpro/internal/jobs"
+	"mailcleanerpro/internal/retention"
+	"mailcleanerpro/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RetentionHandler struct {
+	store *retention.Store
+	jobs  *jobs.Manager
+}
+
+func NewRetentionHandler(store *retention.Store, m *jobs.Manager) *RetentionHandler {
+	return &RetentionHandler{store: store, jobs: m}
+}
+
+// RetentionRuleRequest keeps threads under Label for MaxAgeDays, optionally
+// only cleaning threads of at least MinSizeBytes.
+type RetentionRuleRequest struct {
+	Label        string `json:"label" binding:"required,max=256"`
+	MaxAgeDays   int    `json:"max_age_days" binding:"required,gte=1,lte=36500"`
+	MinSizeBytes int64  `json:"min_size_bytes" binding:"gte=0"`
+}
+
+type RetentionPolicyRequest struct {
+	Name  string                 `json:"name" binding:"required,max=200"`
+	Rules []RetentionRuleRequest `json:"rules" binding:"required,min=1,max=50,dive"`
+}
+
+// RunRetentionRequest controls a run of a saved policy. The body is optional.
+type RunRetentionRequest struct {
+	MaxPerCategory int64  `json:"max_per_category" binding:"gte=0,lte=1000000"`
+	DryRun         bool   `json:"dry_run"`
+	SampleSize     int    `json:"sample_size" binding:"gte=0,lte=100"`
+	OnError        string `json:"on_error" binding:"omitempty,oneof=stop continue"`
+}
+
+// List returns owner's retention policies.
+func (h *RetentionHandler) List(c *gin.Context, owner string) {
+	c.JSON(http.StatusOK, gin.H{"policies": h.store.List(owner)})
+}
+
+// Create saves a new retention policy for owner.
+func (h *RetentionHandler) Create(c *gin.Context, owner string) {
+	p, ok := bindRetentionPolicy(c)
+	if !ok {
+		return
+	}
+	p.Owner = owner
+
+	saved, err := h.store.Create(p)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/api/v1/retention-policies/"+saved.ID)
+	c.JSON(http.StatusCreated, saved)
+}
+
+// Get returns one of owner's retention policies.
+func (h *RetentionHandler) Get(c *gin.Context, owner string) {
+	p, err := h.store.Get(owner, c.Param("id"))
+	if err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// Update replaces the name and rules of one of owner's retention policies.
+func (h *RetentionHandler) Update(c *gin.Context, owner string) {
+	p, ok := bindRetentionPolicy(c)
+	if !ok {
+		return
+	}
+	p.Owner = owner
+	p.ID = c.Param("id")
+
+	saved, err := h.store.Update(p)
+	if err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+// Delete removes one of owner's retention policies.
+func (h *RetentionHandler) Delete(c *gin.Context, owner string) {
+	if err := h.store.Delete(owner, c.Param("id")); err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Run starts a background cleanup job applying one of owner's saved policies,
+// owned by owner too, and responds with 202 Accepted and the job's state.
+func (h *RetentionHandler) Run(c *gin.Context, owner string, cleaner *service.CleanerService) {
+	var req RunRetentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MaxPerCategory == 0 {
+		req.MaxPerCategory = 1000000
+	}
+
+	p, err := h.store.Get(owner, c.Param("id"))
+	if err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+
+	opts := &service.CleanOptions{
+		Retention:      p,
+		MaxPerCategory: req.MaxPerCategory,
+		DryRun:         req.DryRun,
+		SampleSize:     req.SampleSize,
+		OnError:        service.ErrorPolicy(req.OnError),
+	}
+	if err := cleaner.CheckAccess(opts); err != nil {
+		writeGmailError(c, err)
+		return
+	}
+	info, err := h.jobs.Start(cleaner, "me", owner, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := h.store.MarkRun(owner, p.ID, info.ID); err != nil {
+		// The job is already running; failing to record it is not fatal.
+		c.Error(err)
+	}
+	c.Header("Location", "/api/v1/jobs/"+info.ID)
+	c.JSON(http.StatusAccepted, info)
+}
+
+// bindRetentionPolicy parses a RetentionPolicyRequest body, writing a 400
+// response and returning false if it is invalid.
+func bindRetentionPolicy(c *gin.Context) (*service.RetentionPolicy, bool) {
+	var req RetentionPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	p := &service.RetentionPolicy{Name: req.Name}
+	for _, r := range req.Rules {
+		p.Rules = append(p.Rules, service.RetentionRule{
+			Label:        r.Label,
+			MaxAgeDays:   r.MaxAgeDays,
+			MinSizeBytes: r.MinSizeBytes,
+		})
+	}
+	if err := p.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return p, true
+}
+
+func writeRetentionError(c *gin.Context, err error) {
+	if errors.Is(err, retention.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/internal/ids"
+	"mailcleanerpro/internal/journal"
+	"mailcleanerpro/internal/session"
+	"mailcleanerpro/pkg/auth"
+	"mailcleanerpro/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SessionHandler struct {
+	sessions  *session.Store
+	journal   *journal.Store
+	revokeURL string
+}
+
+// NewSessionHandler creates a SessionHandler. Revocations are recorded in
+// journalStore, if set, and sent to revokeURL, or Google's endpoint when empty.
+func NewSessionHandler(sessions *session.Store, journalStore *journal.Store, revokeURL string) *SessionHandler {
+	return &SessionHandler{sessions: sessions, journal: journalStore, revokeURL: revokeURL}
+}
+
+// Me returns the signed-in user of the request's session.
+func (h *SessionHandler) Me(c *gin.Context) {
+	sess, err := h.sessions.FromRequest(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":  "not signed in",
+			"action": "reauth_required",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, sess)
+}
+
+// Logout ends the request's session. The app keeps its access to the account,
+// so signing in again does not ask for consent; use Revoke to remove it.
+func (h *SessionHandler) Logout(c *gin.Context) {
+	if sess, err := h.sessions.FromRequest(c.Request); err == nil {
+		h.sessions.Delete(sess.ID)
+	}
+	h.sessions.ClearCookie(c.Writer)
+	c.JSON(http.StatusOK, gin.H{"signed_out": true})
+}
+
+// Revoke revokes the app's access to the signed-in account with Google, ends
+// all of the account's sessions and deletes its stored token.
+func (h *SessionHandler) Revoke(c *gin.Context) {
+	sess, err := h.sessions.FromRequest(c.Request)
+	if err != nil || sess.Token == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":  "not signed in",
+			"action": "reauth_required",
+		})
+		return
+	}
+
+	// Revoking the refresh token revokes the whole grant.
+	token := sess.Token.RefreshToken
+	if token == "" {
+		token = sess.Token.AccessToken
+	}
+	if err := auth.RevokeToken(c, h.revokeURL, token); err != nil && !errors.Is(err, auth.ErrTokenInvalid) {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.sessions.DeleteUser(sess.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.sessions.ClearCookie(c.Writer)
+	h.journalRevoke(sess)
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+// journalRevoke records a revocation in its own journal. Failures are logged
+// rather than reported, as access has already been revoked.
+func (h *SessionHandler) journalRevoke(sess *session.Session) {
+	if h.journal == nil {
+		return
+	}
+	id, err := ids.New()
+	if err == nil {
+		runID := "revoke-" + id
+		err = h.journal.Append(runID, []journal.Entry{{
+			RunID:  runID,
+			Owner:  sess.Owner(),
+			Time:   time.Now().UTC(),
+			Action: journal.ActionRevoke,
+		}})
+	}
+	if err != nil {
+		logger.L().Error("Failed to journal token revocation",
+			zap.String("user_id", sess.UserID),
+			zap.Error(err),
+		)
+	}
+}
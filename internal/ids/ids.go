@@ -0,0 +1,19 @@
+// Package ids generates the random identifiers of jobs, cleanup runs and
+// saved records.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// New returns a random 128-bit identifier as 32 lower-case hex digits. It
+// fails only if the system's random number generator does.
+func New() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,377 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/internal/ids"
+	"mailcleanerpro/internal/service"
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// Status is the lifecycle state of a job.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// DefaultRetention is how long finished jobs are kept before being forgotten.
+const DefaultRetention = 24 * time.Hour
+
+const (
+	// historySize is the number of recent events replayed to new subscribers.
+	historySize = 100
+	// subscriberBuffer is the event buffer of each subscriber. Events are
+	// dropped for subscribers that fall this far behind.
+	subscriberBuffer = 256
+)
+
+var (
+	// ErrNotFound is returned for unknown or expired job IDs, and for jobs
+	// started by someone else.
+	ErrNotFound = errors.New("job not found")
+	// ErrFinished is returned when cancelling a job that is no longer running.
+	ErrFinished = errors.New("job already finished")
+)
+
+// Progress reports how far a job has got.
+type Progress struct {
+	Selection       string `json:"selection,omitempty"`
+	SelectionsDone  int    `json:"selections_done"`
+	SelectionsTotal int    `json:"selections_total"`
+	// Processed is the number of threads cleaned in finished selections.
+	Processed int `json:"processed"`
+	// SelectionDone and SelectionTotal track the batch in the current selection.
+	SelectionDone  int `json:"selection_done"`
+	SelectionTotal int `json:"selection_total"`
+	Errors         int `json:"errors"`
+}
+
+// apply updates p with a progress event.
+func (p *Progress) apply(e gmail.ProgressEvent) {
+	switch e.Type {
+	case gmail.EventSelectionStarted:
+		p.Selection = e.Selection
+		p.SelectionsDone = e.Done
+		p.SelectionDone, p.SelectionTotal = 0, 0
+	case gmail.EventBatchProgress:
+		p.SelectionDone, p.SelectionTotal = e.Done, e.Total
+	case gmail.EventSelectionFinished:
+		p.SelectionsDone++
+		p.Processed += e.Done
+	case gmail.EventError:
+		p.Errors++
+	}
+}
+
+// Kind is the type of work a job does.
+type Kind string
+
+const (
+	KindCleanup Kind = "cleanup"
+	KindDedup   Kind = "dedup"
+)
+
+// Info is a point-in-time view of a job.
+type Info struct {
+	ID     string `json:"id"`
+	Kind   Kind   `json:"kind"`
+	UserID string `json:"user_id"`
+	// Owner is the owner key of the session that started the job (see
+	// session.Session.Owner). Only the owner can see or cancel it.
+	Owner    string   `json:"owner"`
+	Status   Status   `json:"status"`
+	Progress Progress `json:"progress"`
+	// Summary is set for cleanup jobs and Dedup for dedup jobs.
+	Summary    *service.CleanSummary `json:"summary,omitempty"`
+	Dedup      *service.DedupSummary `json:"dedup,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	ErrorCode  string                `json:"error_code,omitempty"`
+	CreatedAt  time.Time             `json:"created_at"`
+	StartedAt  *time.Time            `json:"started_at,omitempty"`
+	FinishedAt *time.Time            `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether the job has reached a terminal state.
+func (i *Info) Finished() bool {
+	return i.Status == StatusSucceeded || i.Status == StatusFailed || i.Status == StatusCancelled
+}
+
+type job struct {
+	mu          sync.Mutex
+	info        Info
+	cancel      context.CancelFunc
+	history     []gmail.ProgressEvent
+	subscribers map[chan gmail.ProgressEvent]struct{}
+}
+
+// publish records e and forwards it to subscribers. Callers must hold j.mu.
+func (j *job) publish(e gmail.ProgressEvent) {
+	j.info.Progress.apply(e)
+	if len(j.history) == historySize {
+		j.history = append(j.history[:0], j.history[1:]...)
+	}
+	j.history = append(j.history, e)
+	for ch := range j.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// closeSubscribers ends every subscription. Callers must hold j.mu.
+func (j *job) closeSubscribers() {
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+func (j *job) snapshot() Info {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+// Manager runs cleanup and dedup jobs in the background and keeps track of their state.
+type Manager struct {
+	mu        sync.RWMutex
+	jobs      map[string]*job
+	retention time.Duration
+}
+
+// NewManager creates a job manager that keeps finished jobs for retention.
+// A zero retention uses DefaultRetention.
+func NewManager(retention time.Duration) *Manager {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	return &Manager{
+		jobs:      make(map[string]*job),
+		retention: retention,
+	}
+}
+
+// task does the work of a job under ctx, journaling its changes under runID
+// and reporting progress to progress. It returns the job's summary.
+type task func(ctx context.Context, runID string, progress gmail.ProgressFunc) (any, error)
+
+// Start launches a cleanup job for owner in the background and returns its
+// initial state. The job runs under its own context, so it outlives the
+// request that created it.
+func (m *Manager) Start(cleaner *service.CleanerService, userID, owner string, opts *service.CleanOptions) (Info, error) {
+	return m.start(KindCleanup, userID, owner, len(opts.Selections()),
+		func(ctx context.Context, runID string, progress gmail.ProgressFunc) (any, error) {
+			opts.RunID = runID
+			opts.Progress = progress
+			return cleaner.Clean(ctx, userID, opts)
+		},
+		zap.Strings("categories", opts.Categories),
+		zap.String("query", opts.Query),
+		zap.Bool("dry_run", opts.DryRun),
+	)
+}
+
+// StartDedup launches a dedup job for owner in the background, like Start.
+func (m *Manager) StartDedup(cleaner *service.CleanerService, userID, owner string, opts *service.DedupOptions) (Info, error) {
+	return m.start(KindDedup, userID, owner, 0,
+		func(ctx context.Context, runID string, progress gmail.ProgressFunc) (any, error) {
+			opts.RunID = runID
+			opts.Progress = progress
+			return cleaner.Dedup(ctx, userID, opts)
+		},
+		zap.String("query", opts.Query),
+		zap.Bool("dry_run", opts.DryRun),
+	)
+}
+
+func (m *Manager) start(kind Kind, userID, owner string, selections int, t task, fields ...zap.Field) (Info, error) {
+	m.prune()
+
+	id, err := ids.New()
+	if err != nil {
+		return Info{}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		info: Info{
+			ID:        id,
+			Kind:      kind,
+			UserID:    userID,
+			Owner:     owner,
+			Status:    StatusPending,
+			CreatedAt: time.Now().UTC(),
+			Progress:  Progress{SelectionsTotal: selections},
+		},
+		cancel:      cancel,
+		subscribers: make(map[chan gmail.ProgressEvent]struct{}),
+	}
+
+	m.mu.Lock()
+	m.jobs[j.info.ID] = j
+	m.mu.Unlock()
+
+	logger.ServiceLogger("jobs").Info("Job created", append([]zap.Field{
+		zap.String("job_id", j.info.ID),
+		zap.String("kind", string(kind)),
+		zap.String("user_id", userID),
+		zap.String("owner", owner),
+	}, fields...)...)
+
+	go m.run(ctx, j, t)
+
+	return j.snapshot(), nil
+}
+
+func (m *Manager) run(ctx context.Context, j *job, t task) {
+	log := logger.ServiceLogger("jobs").With(zap.String("job_id", j.info.ID), zap.String("kind", string(j.info.Kind)))
+	defer j.cancel()
+
+	j.mu.Lock()
+	if j.info.Status == StatusCancelled {
+		j.closeSubscribers()
+		j.mu.Unlock()
+		return
+	}
+	started := time.Now().UTC()
+	j.info.Status = StatusRunning
+	j.info.StartedAt = &started
+	j.mu.Unlock()
+
+	log.Info("Job started")
+
+	// The job's changes are journaled under its ID so the job can be undone.
+	summary, err := t(ctx, j.info.ID, func(e gmail.ProgressEvent) {
+		j.mu.Lock()
+		j.publish(e)
+		j.mu.Unlock()
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.closeSubscribers()
+	finished := time.Now().UTC()
+	j.info.FinishedAt = &finished
+	switch summary := summary.(type) {
+	case *service.CleanSummary:
+		j.info.Summary = summary
+	case *service.DedupSummary:
+		j.info.Dedup = summary
+	}
+	switch {
+	case ctx.Err() != nil && j.info.Status == StatusCancelled:
+		log.Warn("Job cancelled", zap.Error(err))
+	case err != nil:
+		j.info.Status = StatusFailed
+		j.info.Error = err.Error()
+		j.info.ErrorCode = gmail.Code(err)
+		log.Error("Job failed", zap.Error(err))
+	default:
+		j.info.Status = StatusSucceeded
+		log.Info("Job completed", zap.Duration("duration", finished.Sub(started)))
+	}
+}
+
+// lookup returns the job with id if it belongs to owner.
+func (m *Manager) lookup(id, owner string) (*job, error) {
+	m.mu.RLock()
+	j, ok := m.jobs[id]
+	m.mu.RUnlock()
+	// A job's owner never changes, so it can be read without j.mu.
+	if !ok || j.info.Owner != owner {
+		return nil, ErrNotFound
+	}
+	return j, nil
+}
+
+// Get returns the current state of owner's job.
+func (m *Manager) Get(id, owner string) (Info, error) {
+	j, err := m.lookup(id, owner)
+	if err != nil {
+		return Info{}, err
+	}
+	return j.snapshot(), nil
+}
+
+// Subscribe returns a channel of the progress events of owner's job. Recent
+// events are replayed first. The channel is closed when the job finishes or
+// when the returned function is called; it is nil if the job has already
+// finished.
+func (m *Manager) Subscribe(id, owner string) (<-chan gmail.ProgressEvent, func(), error) {
+	j, err := m.lookup(id, owner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.subscribers == nil {
+		return nil, func() {}, nil
+	}
+	ch := make(chan gmail.ProgressEvent, subscriberBuffer+historySize)
+	for _, e := range j.history {
+		ch <- e
+	}
+	j.subscribers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe, nil
+}
+
+// Cancel stops owner's job if it is pending or running. The job's context is
+// cancelled and in-flight Gmail calls return as soon as the client notices.
+func (m *Manager) Cancel(id, owner string) (Info, error) {
+	j, err := m.lookup(id, owner)
+	if err != nil {
+		return Info{}, err
+	}
+
+	j.mu.Lock()
+	if j.info.Finished() {
+		info := j.info
+		j.mu.Unlock()
+		return info, ErrFinished
+	}
+	j.info.Status = StatusCancelled
+	if j.info.FinishedAt == nil {
+		now := time.Now().UTC()
+		j.info.FinishedAt = &now
+	}
+	info := j.info
+	j.mu.Unlock()
+
+	j.cancel()
+	logger.ServiceLogger("jobs").Info("Job cancellation requested", zap.String("job_id", id))
+	return info, nil
+}
+
+// prune forgets jobs that finished more than the retention period ago.
+func (m *Manager) prune() {
+	cutoff := time.Now().Add(-m.retention)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, j := range m.jobs {
+		info := j.snapshot()
+		if info.Finished() && info.FinishedAt != nil && info.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package journal records the changes made by cleanup runs so they can be
+// undone. Each run is kept in its own JSON-lines file named after the run ID.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when no journal exists for a run ID.
+var ErrNotFound = errors.New("journal not found")
+
+// DefaultDir is where journals are kept when no directory is configured.
+const DefaultDir = "data/journal"
+
+// ActionUndo marks a thread whose change has been reverted.
+const ActionUndo = "undo"
+
+// ActionRevoke records that the owner revoked the app's access to their
+// account. Its entries name no thread and are never undone.
+const ActionRevoke = "revoke"
+
+// Entry records what a run did to one thread, or to a single message of it.
+type Entry struct {
+	RunID string    `json:"run_id"`
+	Owner string    `json:"owner"`
+	Time  time.Time `json:"time"`
+	// Action is the operation applied to the thread, e.g. "trash", or
+	// ActionUndo once the change has been reverted. ActionRevoke entries
+	// record account events rather than thread changes.
+	Action   string `json:"action"`
+	ThreadID string `json:"thread_id"`
+	// MessageID is set when the run changed only this message of the thread,
+	// as dedup does.
+	MessageID string `json:"message_id,omitempty"`
+	// AddedLabels and RemovedLabels are the labels the operation changed.
+	AddedLabels   []string `json:"added_labels,omitempty"`
+	RemovedLabels []string `json:"removed_labels,omitempty"`
+}
+
+// validRunID guards against run IDs escaping the journal directory.
+var validRunID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// Store keeps journals in a directory. It is safe for concurrent use.
+type Store struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewStore opens the journal directory at dir, creating it if needed. An empty
+// dir uses DefaultDir.
+func NewStore(dir string) (*Store, error) {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create journal directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(runID string) (string, error) {
+	if !validRunID.MatchString(runID) {
+		return "", fmt.Errorf("invalid run ID %q", runID)
+	}
+	return filepath.Join(s.dir, runID+".jsonl"), nil
+}
+
+// Append adds entries to the journal of runID.
+func (s *Store) Append(runID string, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	path, err := s.path(runID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return fmt.Errorf("write journal: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	return nil
+}
+
+// Read returns the entries of runID in the order they were written.
+func (s *Store) Read(runID string) ([]Entry, error) {
+	path, err := s.path(runID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e Entry
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("read journal %s: %w", runID, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Pending returns the entries of a run that have not been undone, latest first,
+// so that reverting them in order unwinds the run.
+func Pending(entries []Entry) []Entry {
+	undone := make(map[string]bool)
+	for _, e := range entries {
+		if e.Action == ActionUndo {
+			undone[e.target()] = true
+		}
+	}
+	var pending []Entry
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Action != ActionUndo && e.Action != ActionRevoke && !undone[e.target()] {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+// target identifies what e changed: a single message or a whole thread.
+func (e Entry) target() string {
+	if e.MessageID != "" {
+		return "message:" + e.MessageID
+	}
+	return "thread:" + e.ThreadID
+}
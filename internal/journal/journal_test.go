@@ -0,0 +1,46 @@
+package journal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPending(t *testing.T) {
+	trash := func(thread, message string) Entry {
+		return Entry{Action: "trash", ThreadID: thread, MessageID: message}
+	}
+	undo := func(thread, message string) Entry {
+		return Entry{Action: ActionUndo, ThreadID: thread, MessageID: message}
+	}
+	tests := []struct {
+		name    string
+		entries []Entry
+		want    []Entry
+	}{
+		{"nothing undone", []Entry{trash("t1", ""), trash("t2", "")}, []Entry{trash("t2", ""), trash("t1", "")}},
+		{"thread undone", []Entry{trash("t1", ""), trash("t2", ""), undo("t1", "")}, []Entry{trash("t2", "")}},
+		{"revocations are never pending", []Entry{{Action: ActionRevoke}}, nil},
+		{
+			"message undone",
+			[]Entry{trash("t1", "m1"), trash("t1", "m2"), undo("t1", "m1")},
+			[]Entry{trash("t1", "m2")},
+		},
+		{
+			"undoing a message does not undo its thread",
+			[]Entry{trash("t1", ""), trash("t1", "m1"), undo("t1", "m1")},
+			[]Entry{trash("t1", "")},
+		},
+		{
+			"undoing a thread does not undo its messages",
+			[]Entry{trash("t1", ""), trash("t1", "m1"), undo("t1", "")},
+			[]Entry{trash("t1", "m1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Pending(tt.entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Pending() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -205,12 +205,12 @@ func logDetailedRequest(logger *zap.Logger, c *gin.Context, requestBody []byte)
 	headers := make(map[string]string)
 	// Only log safe headers; mask all others
 	safeHeaders := map[string]bool{
-		"User-Agent":  true,
-		"Referer":     true,
-		"Accept":      true,
+		"User-Agent":      true,
+		"Referer":         true,
+		"Accept":          true,
 		"Accept-Language": true,
 		"Accept-Encoding": true,
-		"Content-Type": true,
+		"Content-Type":    true,
 	}
 	for name, values := range c.Request.Header {
 		if safeHeaders[name] {
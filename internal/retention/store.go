@@ -0,0 +1,199 @@
+// Package retention persists retention policies so they can be re-run.
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"mailcleanerpro/internal/ids"
+	"mailcleanerpro/internal/service"
+)
+
+// ErrNotFound is returned for unknown policy IDs, or policies owned by
+// someone else.
+var ErrNotFound = errors.New("retention policy not found")
+
+// DefaultPath is where policies are stored when no path is configured.
+const DefaultPath = "data/retention_policies.json"
+
+// Store keeps retention policies in a JSON file. It is safe for concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	policies map[string]*service.RetentionPolicy
+}
+
+// NewStore opens the policy file at path, creating it on first save. An empty
+// path uses DefaultPath.
+func NewStore(path string) (*Store, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+	s := &Store{path: path, policies: make(map[string]*service.RetentionPolicy)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read retention policies: %w", err)
+	}
+	var policies []*service.RetentionPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("parse retention policies %s: %w", path, err)
+	}
+	for _, p := range policies {
+		s.policies[p.ID] = p
+	}
+	return s, nil
+}
+
+// List returns the policies of owner, oldest first.
+func (s *Store) List(owner string) []*service.RetentionPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*service.RetentionPolicy, 0)
+	for _, p := range s.policies {
+		if p.Owner == owner {
+			list = append(list, clonePolicy(p))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Get returns the policy with the given ID owned by owner.
+func (s *Store) Get(owner, id string) (*service.RetentionPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.policies[id]
+	if !ok || p.Owner != owner {
+		return nil, ErrNotFound
+	}
+	return clonePolicy(p), nil
+}
+
+// Create saves a new policy, assigning its ID and timestamps.
+func (s *Store) Create(p *service.RetentionPolicy) (*service.RetentionPolicy, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := ids.New()
+	if err != nil {
+		return nil, err
+	}
+	p = clonePolicy(p)
+	p.ID = id
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	s.policies[p.ID] = p
+	if err := s.save(); err != nil {
+		delete(s.policies, p.ID)
+		return nil, err
+	}
+	return clonePolicy(p), nil
+}
+
+// Update replaces the name and rules of an existing policy owned by p.Owner.
+func (s *Store) Update(p *service.RetentionPolicy) (*service.RetentionPolicy, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return s.modify(p.Owner, p.ID, func(existing *service.RetentionPolicy) {
+		existing.Name = p.Name
+		existing.Rules = append([]service.RetentionRule(nil), p.Rules...)
+		existing.UpdatedAt = time.Now().UTC()
+	})
+}
+
+// MarkRun records that a policy was run as the given background job.
+func (s *Store) MarkRun(owner, id, jobID string) (*service.RetentionPolicy, error) {
+	return s.modify(owner, id, func(existing *service.RetentionPolicy) {
+		now := time.Now().UTC()
+		existing.LastRunAt = &now
+		existing.LastJobID = jobID
+	})
+}
+
+// Delete removes a policy owned by owner.
+func (s *Store) Delete(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.policies[id]
+	if !ok || p.Owner != owner {
+		return ErrNotFound
+	}
+	delete(s.policies, id)
+	if err := s.save(); err != nil {
+		s.policies[id] = p
+		return err
+	}
+	return nil
+}
+
+// modify applies fn to a copy of a stored policy and saves it.
+func (s *Store) modify(owner, id string, fn func(*service.RetentionPolicy)) (*service.RetentionPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.policies[id]
+	if !ok || old.Owner != owner {
+		return nil, ErrNotFound
+	}
+	p := clonePolicy(old)
+	fn(p)
+	s.policies[id] = p
+	if err := s.save(); err != nil {
+		s.policies[id] = old
+		return nil, err
+	}
+	return clonePolicy(p), nil
+}
+
+// save writes all policies to disk, replacing the file atomically. The caller
+// must hold s.mu.
+func (s *Store) save() error {
+	policies := make([]*service.RetentionPolicy, 0, len(s.policies))
+	for _, p := range s.policies {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].CreatedAt.Before(policies[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode retention policies: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("create retention policy directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write retention policies: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write retention policies: %w", err)
+	}
+	return nil
+}
+
+func clonePolicy(p *service.RetentionPolicy) *service.RetentionPolicy {
+	c := *p
+	c.Rules = append([]service.RetentionRule(nil), p.Rules...)
+	if p.LastRunAt != nil {
+		t := *p.LastRunAt
+		c.LastRunAt = &t
+	}
+	return &c
+}
@@ -0,0 +1,314 @@
+// Package rules evaluates ordered, declarative cleanup rules against Gmail
+// thread metadata.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"mailcleanerpro/pkg/gmail"
+)
+
+// Action is what a rule does to the threads it matches.
+type Action string
+
+const (
+	// ActionTrash moves threads to trash.
+	ActionTrash Action = "trash"
+	// ActionDelete permanently deletes threads.
+	ActionDelete Action = "delete"
+	// ActionArchive removes threads from the inbox.
+	ActionArchive Action = "archive"
+	// ActionLabel adds and removes labels.
+	ActionLabel Action = "label"
+	// ActionMarkRead marks threads as read.
+	ActionMarkRead Action = "mark_read"
+	// ActionMove moves threads out of the inbox into Operation.LabelID.
+	ActionMove Action = "move"
+)
+
+// Operation is an action together with the labels it needs.
+type Operation struct {
+	Action Action `json:"action"`
+	// LabelID is the destination of ActionMove. With ActionLabel it is
+	// shorthand for a single entry in AddLabels.
+	LabelID string `json:"label_id,omitempty"`
+	// AddLabels and RemoveLabels are the label changes of ActionLabel.
+	AddLabels    []string `json:"add_labels,omitempty"`
+	RemoveLabels []string `json:"remove_labels,omitempty"`
+}
+
+// Destructive reports whether the operation trashes or deletes threads rather
+// than changing their labels.
+func (o Operation) Destructive() bool {
+	return o.Action == ActionTrash || o.Action == ActionDelete
+}
+
+// LabelChanges returns the labels a non-destructive operation adds and removes.
+func (o Operation) LabelChanges() (add, remove []string) {
+	switch o.Action {
+	case ActionArchive:
+		return nil, []string{"INBOX"}
+	case ActionMarkRead:
+		return nil, []string{"UNREAD"}
+	case ActionMove:
+		return []string{o.LabelID}, []string{"INBOX"}
+	case ActionLabel:
+		add = append([]string(nil), o.AddLabels...)
+		if o.LabelID != "" {
+			add = append(add, o.LabelID)
+		}
+		return add, append([]string(nil), o.RemoveLabels...)
+	}
+	return nil, nil
+}
+
+// Validate reports whether the operation is complete. The field of the
+// returned *ValidationError is set; its index is left to the caller.
+func (o Operation) Validate() error {
+	invalid := func(field, format string, args ...any) error {
+		return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+	}
+	switch o.Action {
+	case ActionTrash, ActionDelete, ActionArchive, ActionMarkRead:
+		if o.LabelID != "" || len(o.AddLabels) > 0 || len(o.RemoveLabels) > 0 {
+			return invalid("label_id", "labels are only allowed with the %q and %q actions", ActionLabel, ActionMove)
+		}
+	case ActionMove:
+		if o.LabelID == "" {
+			return invalid("label_id", "required by the %q action", ActionMove)
+		}
+		if len(o.AddLabels) > 0 || len(o.RemoveLabels) > 0 {
+			return invalid("add_labels", "only allowed with the %q action", ActionLabel)
+		}
+	case ActionLabel:
+		if o.LabelID == "" && len(o.AddLabels) == 0 && len(o.RemoveLabels) == 0 {
+			return invalid("add_labels", "the %q action needs labels to add or remove", ActionLabel)
+		}
+	case "":
+		return invalid("action", "required")
+	default:
+		return invalid("action", "unknown action %q", o.Action)
+	}
+	return nil
+}
+
+// Match lists the conditions a thread must meet for a rule to apply. Every
+// condition that is set must hold; at least one must be set.
+type Match struct {
+	// From matches the sender's address exactly, or a domain (example.com or
+	// @example.com) and its subdomains, case-insensitively.
+	From string `json:"from,omitempty"`
+	// SubjectRegex is a Go regular expression matched against the subject.
+	SubjectRegex string `json:"subject_regex,omitempty"`
+	// Label is a Gmail label ID the thread must carry.
+	Label string `json:"label,omitempty"`
+	// OlderThanDays matches threads whose latest message is at least this old.
+	OlderThanDays int `json:"older_than_days,omitempty"`
+	// LargerThanBytes matches threads at least this large.
+	LargerThanBytes int64 `json:"larger_than_bytes,omitempty"`
+	// HasAttachment, if set, matches threads with or without attachments.
+	HasAttachment *bool `json:"has_attachment,omitempty"`
+	// ListID matches the identifier in the List-Id header of mailing list
+	// mail, e.g. news.example.com, exactly but case-insensitively.
+	ListID string `json:"list_id,omitempty"`
+}
+
+func (m Match) empty() bool {
+	return m.From == "" && m.SubjectRegex == "" && m.Label == "" && m.OlderThanDays == 0 &&
+		m.LargerThanBytes == 0 && m.HasAttachment == nil && m.ListID == ""
+}
+
+// Rule applies an Operation to threads meeting Match.
+type Rule struct {
+	Name  string `json:"name"`
+	Match Match  `json:"match"`
+	Operation
+}
+
+// ValidationError reports an invalid rule.
+type ValidationError struct {
+	// Index is the position of the rule in the list.
+	Index int `json:"index"`
+	// Field is the JSON name of the offending field.
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("rule %d: %s: %s", e.Index, e.Field, e.Message)
+}
+
+// compiledRule is a validated Rule with its regular expression compiled.
+type compiledRule struct {
+	Rule
+	subject *regexp.Regexp
+}
+
+// Set is a validated, ordered list of rules.
+type Set struct {
+	rules []compiledRule
+}
+
+// Compile validates rules and returns them as a Set. Unnamed rules are named
+// after their position. The error is a *ValidationError.
+func Compile(rules []Rule) (*Set, error) {
+	set := &Set{rules: make([]compiledRule, 0, len(rules))}
+	names := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		invalid := func(field, format string, args ...any) error {
+			return &ValidationError{Index: i, Field: field, Message: fmt.Sprintf(format, args...)}
+		}
+
+		r.Name = strings.TrimSpace(r.Name)
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if names[r.Name] {
+			return nil, invalid("name", "duplicate rule name %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if r.Match.empty() {
+			return nil, invalid("match", "at least one condition is required")
+		}
+		if r.Match.OlderThanDays < 0 {
+			return nil, invalid("match.older_than_days", "must not be negative")
+		}
+		if r.Match.LargerThanBytes < 0 {
+			return nil, invalid("match.larger_than_bytes", "must not be negative")
+		}
+		if r.Match.From != "" && strings.Trim(r.Match.From, " @") == "" {
+			return nil, invalid("match.from", "must be an email address or domain")
+		}
+		if r.Match.ListID != "" && listID(r.Match.ListID) == "" {
+			return nil, invalid("match.list_id", "must not be empty")
+		}
+
+		c := compiledRule{Rule: r}
+		if r.Match.SubjectRegex != "" {
+			re, err := regexp.Compile(r.Match.SubjectRegex)
+			if err != nil {
+				return nil, invalid("match.subject_regex", "%v", err)
+			}
+			c.subject = re
+		}
+
+		if err := r.Operation.Validate(); err != nil {
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				return nil, invalid("action", "%v", err)
+			}
+			verr.Index = i
+			return nil, verr
+		}
+
+		set.rules = append(set.rules, c)
+	}
+	return set, nil
+}
+
+// Rules returns the rules of the set in order.
+func (s *Set) Rules() []Rule {
+	rules := make([]Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rules = append(rules, r.Rule)
+	}
+	return rules
+}
+
+// Evaluate returns the first rule matching meta, or false if none does.
+func (s *Set) Evaluate(meta *gmail.ThreadMetadata, now time.Time) (Rule, bool) {
+	for _, r := range s.rules {
+		if r.matches(meta, now) {
+			return r.Rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (r compiledRule) matches(meta *gmail.ThreadMetadata, now time.Time) bool {
+	m := r.Match
+	if m.From != "" && !MatchSender(meta.From, m.From) {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(meta.Subject) {
+		return false
+	}
+	if m.Label != "" && !hasLabel(meta.LabelIDs, m.Label) {
+		return false
+	}
+	if m.OlderThanDays > 0 && (meta.Date.IsZero() || meta.Date.After(now.AddDate(0, 0, -m.OlderThanDays))) {
+		return false
+	}
+	if m.LargerThanBytes > 0 && meta.SizeEstimate < m.LargerThanBytes {
+		return false
+	}
+	if m.HasAttachment != nil && meta.HasAttachment != *m.HasAttachment {
+		return false
+	}
+	if m.ListID != "" && !strings.EqualFold(listID(meta.ListID), listID(m.ListID)) {
+		return false
+	}
+	return true
+}
+
+// MatchSender reports whether the From header from was sent by pattern: an
+// email address, matched exactly, or a domain (example.com or @example.com),
+// which also matches its subdomains. Both are compared case-insensitively.
+func MatchSender(from, pattern string) bool {
+	addr := senderAddress(from)
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if addr == "" || pattern == "" {
+		return false
+	}
+	if strings.Contains(strings.TrimPrefix(pattern, "@"), "@") {
+		return addr == pattern
+	}
+	domain := strings.TrimPrefix(pattern, "@")
+	host := addr[strings.LastIndex(addr, "@")+1:]
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// senderAddress returns the lower-cased address of a From header, or "" if it
+// has none. Headers net/mail rejects, such as unencoded non-ASCII display
+// names, fall back to the text between the last angle brackets.
+func senderAddress(from string) string {
+	var addr string
+	if a, err := mail.ParseAddress(from); err == nil {
+		addr = a.Address
+	} else {
+		addr = strings.TrimSpace(from)
+		if i := strings.LastIndex(addr, "<"); i >= 0 {
+			addr, _, _ = strings.Cut(addr[i+1:], ">")
+		}
+	}
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if strings.ContainsAny(addr, " <>") || !strings.Contains(addr, "@") {
+		return ""
+	}
+	return addr
+}
+
+// listID returns the identifier of a List-Id header, the text between its
+// angle brackets (RFC 2919), or the whole trimmed value if it has none.
+func listID(header string) string {
+	header = strings.TrimSpace(header)
+	if i := strings.LastIndex(header, "<"); i >= 0 {
+		header, _, _ = strings.Cut(header[i+1:], ">")
+	}
+	return strings.TrimSpace(header)
+}
+
+func hasLabel(labelIDs []string, label string) bool {
+	for _, l := range labelIDs {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
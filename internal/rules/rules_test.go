@@ -0,0 +1,150 @@
+package rules
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"mailcleanerpro/pkg/gmail"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []Rule
+		wantIndex int
+		wantField string // empty when the rules are valid
+	}{
+		{
+			name:  "valid",
+			rules: []Rule{{Name: "news", Match: Match{From: "example.com"}, Operation: Operation{Action: ActionTrash}}},
+		},
+		{
+			name: "duplicate name",
+			rules: []Rule{
+				{Name: "a", Match: Match{Label: "INBOX"}, Operation: Operation{Action: ActionArchive}},
+				{Name: "a", Match: Match{Label: "SPAM"}, Operation: Operation{Action: ActionDelete}},
+			},
+			wantIndex: 1,
+			wantField: "name",
+		},
+		{
+			name:      "no conditions",
+			rules:     []Rule{{Operation: Operation{Action: ActionTrash}}},
+			wantField: "match",
+		},
+		{
+			name:      "negative age",
+			rules:     []Rule{{Match: Match{OlderThanDays: -1}, Operation: Operation{Action: ActionTrash}}},
+			wantField: "match.older_than_days",
+		},
+		{
+			name:      "bad subject regex",
+			rules:     []Rule{{Match: Match{SubjectRegex: "("}, Operation: Operation{Action: ActionTrash}}},
+			wantField: "match.subject_regex",
+		},
+		{
+			name:      "empty sender",
+			rules:     []Rule{{Match: Match{From: "@"}, Operation: Operation{Action: ActionTrash}}},
+			wantField: "match.from",
+		},
+		{
+			name:      "empty list ID",
+			rules:     []Rule{{Match: Match{ListID: "<>"}, Operation: Operation{Action: ActionTrash}}},
+			wantField: "match.list_id",
+		},
+		{
+			name:      "move without label",
+			rules:     []Rule{{Match: Match{Label: "INBOX"}, Operation: Operation{Action: ActionMove}}},
+			wantField: "label_id",
+		},
+		{
+			name:      "unknown action",
+			rules:     []Rule{{Match: Match{Label: "INBOX"}, Operation: Operation{Action: "shred"}}},
+			wantField: "action",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := Compile(tt.rules)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatalf("Compile() = %v, want no error", err)
+				}
+				if got := len(set.Rules()); got != len(tt.rules) {
+					t.Errorf("Compile() returned %d rules, want %d", got, len(tt.rules))
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Compile() = %v, want a *ValidationError", err)
+			}
+			if verr.Index != tt.wantIndex || verr.Field != tt.wantField {
+				t.Errorf("Compile() failed on rule %d field %q, want rule %d field %q",
+					verr.Index, verr.Field, tt.wantIndex, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	yes, no := true, false
+	tests := []struct {
+		name  string
+		match Match
+		meta  gmail.ThreadMetadata
+		want  bool
+	}{
+		{"exact address", Match{From: "news@example.com"}, gmail.ThreadMetadata{From: "News <News@Example.com>"}, true},
+		{"address is not a substring match", Match{From: "news@example.com"}, gmail.ThreadMetadata{From: "<fakenews@example.com>"}, false},
+		{"domain", Match{From: "example.com"}, gmail.ThreadMetadata{From: "a@example.com"}, true},
+		{"domain with at sign", Match{From: "@example.com"}, gmail.ThreadMetadata{From: "a@example.com"}, true},
+		{"subdomain", Match{From: "example.com"}, gmail.ThreadMetadata{From: "a@mail.example.com"}, true},
+		{"domain needs a dot boundary", Match{From: "example.com"}, gmail.ThreadMetadata{From: "a@notexample.com"}, false},
+		{"domain is not matched in the local part", Match{From: "example.com"}, gmail.ThreadMetadata{From: "example.com@evil.test"}, false},
+		{"unparseable display name", Match{From: "example.com"}, gmail.ThreadMetadata{From: "Zoë Ünïcode <z@example.com>"}, true},
+		{"no sender", Match{From: "example.com"}, gmail.ThreadMetadata{}, false},
+		{"list ID", Match{ListID: "news.example.com"}, gmail.ThreadMetadata{ListID: "Weekly News <News.Example.com>"}, true},
+		{"list ID with brackets", Match{ListID: "<news.example.com>"}, gmail.ThreadMetadata{ListID: "<news.example.com>"}, true},
+		{"list ID is not a substring match", Match{ListID: "example.com"}, gmail.ThreadMetadata{ListID: "<news.example.com>"}, false},
+		{"subject regex", Match{SubjectRegex: `(?i)^sale`}, gmail.ThreadMetadata{Subject: "SALE now on"}, true},
+		{"label", Match{Label: "CATEGORY_PROMOTIONS"}, gmail.ThreadMetadata{LabelIDs: []string{"INBOX", "CATEGORY_PROMOTIONS"}}, true},
+		{"missing label", Match{Label: "CATEGORY_PROMOTIONS"}, gmail.ThreadMetadata{LabelIDs: []string{"INBOX"}}, false},
+		{"old enough", Match{OlderThanDays: 30}, gmail.ThreadMetadata{Date: now.AddDate(0, 0, -31)}, true},
+		{"too recent", Match{OlderThanDays: 30}, gmail.ThreadMetadata{Date: now.AddDate(0, 0, -29)}, false},
+		{"unknown date", Match{OlderThanDays: 30}, gmail.ThreadMetadata{}, false},
+		{"large enough", Match{LargerThanBytes: 1000}, gmail.ThreadMetadata{SizeEstimate: 1000}, true},
+		{"too small", Match{LargerThanBytes: 1000}, gmail.ThreadMetadata{SizeEstimate: 999}, false},
+		{"has attachment", Match{HasAttachment: &yes}, gmail.ThreadMetadata{HasAttachment: true}, true},
+		{"has no attachment", Match{HasAttachment: &no}, gmail.ThreadMetadata{HasAttachment: true}, false},
+		{"all conditions", Match{From: "example.com", Label: "INBOX"}, gmail.ThreadMetadata{From: "a@example.com", LabelIDs: []string{"INBOX"}}, true},
+		{"one condition fails", Match{From: "example.com", Label: "INBOX"}, gmail.ThreadMetadata{From: "a@example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := Compile([]Rule{{Match: tt.match, Operation: Operation{Action: ActionTrash}}})
+			if err != nil {
+				t.Fatalf("Compile() = %v", err)
+			}
+			if _, got := set.Evaluate(&tt.meta, now); got != tt.want {
+				t.Errorf("rule matched = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateFirstMatchWins(t *testing.T) {
+	set, err := Compile([]Rule{
+		{Name: "keep-receipts", Match: Match{SubjectRegex: "receipt"}, Operation: Operation{Action: ActionArchive}},
+		{Name: "shop", Match: Match{From: "shop.example"}, Operation: Operation{Action: ActionTrash}},
+	})
+	if err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	rule, ok := set.Evaluate(&gmail.ThreadMetadata{From: "orders@shop.example", Subject: "Your receipt"}, time.Now())
+	if !ok || rule.Name != "keep-receipts" {
+		t.Errorf("Evaluate() = %q, %v; want keep-receipts", rule.Name, ok)
+	}
+}
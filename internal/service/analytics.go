@@ -0,0 +1,246 @@
+package service
+
+import (
+	"context"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// DefaultAnalyticsMaxMessages and DefaultAnalyticsTop are used when
+// AnalyticsOptions leaves MaxMessages and Top unset.
+const (
+	DefaultAnalyticsMaxMessages = 2000
+	DefaultAnalyticsTop         = 25
+)
+
+// AnalyticsSort orders the sender and domain breakdowns of a report.
+type AnalyticsSort string
+
+const (
+	// SortByCount puts the buckets with the most messages first. It is the default.
+	SortByCount AnalyticsSort = "count"
+	// SortBySize puts the buckets taking the most space first.
+	SortBySize AnalyticsSort = "size"
+)
+
+// AnalyticsOptions selects the messages a mailbox report covers.
+type AnalyticsOptions struct {
+	// Query is a Gmail search query. By default the whole mailbox is scanned,
+	// including spam and trash.
+	Query string
+	// MaxMessages caps the number of messages scanned.
+	MaxMessages int64
+	// Top is the number of senders and domains reported.
+	Top  int
+	Sort AnalyticsSort
+}
+
+// AnalyticsBucket aggregates the messages sharing one value of a dimension.
+type AnalyticsBucket struct {
+	Key string `json:"key"`
+	// Name is the display name of a label, when it differs from its ID.
+	Name      string `json:"name,omitempty"`
+	Count     int    `json:"count"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// AnalyticsReport breaks a mailbox down by sender, sender domain, label,
+// category and age.
+type AnalyticsReport struct {
+	Query       string    `json:"query,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Scanned     int       `json:"scanned"`
+	// Failed counts messages whose metadata could not be fetched.
+	Failed    int   `json:"failed"`
+	SizeBytes int64 `json:"size_bytes"`
+	// Truncated is set when the scan stopped at MaxMessages, so more
+	// messages may remain.
+	Truncated bool `json:"truncated"`
+	// Senders and Domains are the Top buckets in the requested order.
+	Senders []*AnalyticsBucket `json:"senders"`
+	Domains []*AnalyticsBucket `json:"domains"`
+	// Labels covers every label except categories, which are reported in
+	// Categories along with "CATEGORY_PERSONAL" for uncategorised mail.
+	Labels     []*AnalyticsBucket `json:"labels"`
+	Categories []*AnalyticsBucket `json:"categories"`
+	// Ages buckets messages by when they were received, newest first.
+	Ages []*AnalyticsBucket `json:"ages"`
+}
+
+// ageBuckets are the age ranges of AnalyticsReport.Ages, in order.
+var ageBuckets = []struct {
+	key    string
+	maxAge time.Duration
+}{
+	{"under_1_week", 7 * 24 * time.Hour},
+	{"1_week_to_1_month", 30 * 24 * time.Hour},
+	{"1_to_6_months", 182 * 24 * time.Hour},
+	{"6_to_12_months", 365 * 24 * time.Hour},
+	{"1_to_2_years", 2 * 365 * 24 * time.Hour},
+	{"over_2_years", 0},
+}
+
+type AnalyticsService struct {
+	gmail *gmail.Service
+}
+
+func NewAnalyticsService(g *gmail.Service) *AnalyticsService {
+	return &AnalyticsService{gmail: g}
+}
+
+// Analyze scans the metadata of the messages selected by opts and aggregates
+// it. Only headers are fetched; message bodies are never downloaded.
+func (s *AnalyticsService) Analyze(ctx context.Context, userID string, opts *AnalyticsOptions) (*AnalyticsReport, error) {
+	maxMessages := opts.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = DefaultAnalyticsMaxMessages
+	}
+	top := opts.Top
+	if top <= 0 {
+		top = DefaultAnalyticsTop
+	}
+
+	start := time.Now()
+	logger.L().Info("Starting mailbox analysis",
+		zap.String("user_id", userID),
+		zap.String("query", opts.Query),
+		zap.Int64("max_messages", maxMessages),
+	)
+
+	report := &AnalyticsReport{Query: opts.Query, GeneratedAt: start.UTC()}
+	senders := make(map[string]*AnalyticsBucket)
+	domains := make(map[string]*AnalyticsBucket)
+	labels := make(map[string]*AnalyticsBucket)
+	categories := make(map[string]*AnalyticsBucket)
+	ages := make([]*AnalyticsBucket, len(ageBuckets))
+	for i, b := range ageBuckets {
+		ages[i] = &AnalyticsBucket{Key: b.key}
+	}
+
+	failed, err := s.gmail.ScanMessageMetadata(ctx, userID, opts.Query, maxMessages, func(m *gmail.MessageMetadata) {
+		report.Scanned++
+		report.SizeBytes += m.SizeEstimate
+
+		sender, domain := parseSender(m.From)
+		addToBucket(senders, sender, m.SizeEstimate)
+		addToBucket(domains, domain, m.SizeEstimate)
+
+		category := "CATEGORY_PERSONAL"
+		for _, l := range m.LabelIDs {
+			if strings.HasPrefix(l, "CATEGORY_") {
+				category = l
+				continue
+			}
+			addToBucket(labels, l, m.SizeEstimate)
+		}
+		addToBucket(categories, category, m.SizeEstimate)
+
+		age := start.Sub(m.Date)
+		for i, b := range ageBuckets {
+			if b.maxAge == 0 || age < b.maxAge {
+				ages[i].Count++
+				ages[i].SizeBytes += m.SizeEstimate
+				break
+			}
+		}
+	})
+	report.Failed = failed
+	if err != nil {
+		return nil, err
+	}
+	report.Truncated = int64(report.Scanned+report.Failed) >= maxMessages
+
+	report.Senders = topBuckets(senders, opts.Sort, top)
+	report.Domains = topBuckets(domains, opts.Sort, top)
+	report.Labels = topBuckets(labels, SortByCount, 0)
+	report.Categories = topBuckets(categories, SortByCount, 0)
+	report.Ages = ages
+	s.nameLabels(ctx, userID, report.Labels)
+
+	logger.L().Info("Completed mailbox analysis",
+		zap.String("user_id", userID),
+		zap.Int("scanned_count", report.Scanned),
+		zap.Int("failed_count", report.Failed),
+		zap.Int64("size_bytes", report.SizeBytes),
+		zap.Bool("truncated", report.Truncated),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return report, nil
+}
+
+// nameLabels sets the display names of user labels. Failures are logged and
+// leave the buckets with IDs only.
+func (s *AnalyticsService) nameLabels(ctx context.Context, userID string, buckets []*AnalyticsBucket) {
+	list, err := s.gmail.ListLabels(ctx, userID)
+	if err != nil {
+		logger.L().Warn("Failed to fetch label names for analysis", zap.Error(err))
+		return
+	}
+	names := make(map[string]string, len(list))
+	for _, l := range list {
+		names[l.Id] = l.Name
+	}
+	for _, b := range buckets {
+		if name := names[b.Key]; name != "" && name != b.Key {
+			b.Name = name
+		}
+	}
+}
+
+// parseSender returns the lower-cased address of a From header and its domain.
+// Headers that do not parse are used as they are.
+func parseSender(from string) (sender, domain string) {
+	sender = strings.ToLower(strings.TrimSpace(from))
+	if addr, err := mail.ParseAddress(from); err == nil {
+		sender = strings.ToLower(addr.Address)
+	}
+	if sender == "" {
+		return "(unknown)", "(unknown)"
+	}
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		return sender, strings.TrimRight(sender[i+1:], ">")
+	}
+	return sender, "(unknown)"
+}
+
+func addToBucket(buckets map[string]*AnalyticsBucket, key string, size int64) {
+	b := buckets[key]
+	if b == nil {
+		b = &AnalyticsBucket{Key: key}
+		buckets[key] = b
+	}
+	b.Count++
+	b.SizeBytes += size
+}
+
+// topBuckets returns up to n buckets ordered by by, or all of them when n is 0.
+func topBuckets(buckets map[string]*AnalyticsBucket, by AnalyticsSort, n int) []*AnalyticsBucket {
+	list := make([]*AnalyticsBucket, 0, len(buckets))
+	for _, b := range buckets {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if by == SortBySize && a.SizeBytes != b.SizeBytes {
+			return a.SizeBytes > b.SizeBytes
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.SizeBytes != b.SizeBytes {
+			return a.SizeBytes > b.SizeBytes
+		}
+		return a.Key < b.Key
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
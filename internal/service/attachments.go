@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// DefaultLargeAttachmentSize is the message size from which messages with
+// attachments are reported when LargeAttachmentOptions.MinSizeBytes is unset.
+const DefaultLargeAttachmentSize = 5 << 20
+
+// DefaultLargeAttachmentMaxThreads is the number of threads examined when
+// LargeAttachmentOptions.MaxThreads is unset.
+const DefaultLargeAttachmentMaxThreads = 500
+
+// LargeAttachmentOptions selects the messages a large-attachment report covers.
+type LargeAttachmentOptions struct {
+	MinSizeBytes int64
+	// Query is a Gmail search query further narrowing the selection.
+	Query      string
+	MaxThreads int64
+}
+
+// LargeAttachmentReport lists messages with attachments of at least
+// MinSizeBytes, largest first.
+type LargeAttachmentReport struct {
+	MinSizeBytes int64 `json:"min_size_bytes"`
+	// Query is the Gmail search query the report was built from. Clean it
+	// to remove the reported threads.
+	Query          string                      `json:"query"`
+	Threads        int                         `json:"threads"`
+	TotalSizeBytes int64                       `json:"total_size_bytes"`
+	Messages       []*gmail.MessageAttachments `json:"messages"`
+	// Failed lists threads whose attachments could not be inspected.
+	Failed []*FailedThread `json:"failed,omitempty"`
+}
+
+// LargeAttachmentQuery returns the Gmail search query selecting threads with
+// a message of at least minSize bytes that has attachments, narrowed by query.
+func LargeAttachmentQuery(minSize int64, query string) string {
+	q := fmt.Sprintf("has:attachment larger:%d", minSize)
+	if query != "" {
+		q += " (" + query + ")"
+	}
+	return q
+}
+
+// LargeAttachments reports the messages with attachments of at least
+// opts.MinSizeBytes, sorted by size. Protected threads are left out, as they
+// would be by a cleanup.
+func (s *CleanerService) LargeAttachments(ctx context.Context, userID string, opts *LargeAttachmentOptions) (*LargeAttachmentReport, error) {
+	minSize := opts.MinSizeBytes
+	if minSize <= 0 {
+		minSize = DefaultLargeAttachmentSize
+	}
+	maxThreads := opts.MaxThreads
+	if maxThreads <= 0 {
+		maxThreads = DefaultLargeAttachmentMaxThreads
+	}
+
+	start := time.Now()
+	report := &LargeAttachmentReport{
+		MinSizeBytes: minSize,
+		Query:        LargeAttachmentQuery(minSize, opts.Query),
+		Messages:     []*gmail.MessageAttachments{},
+	}
+	sel := Selection{Name: report.Query, Query: report.Query}
+	threads, err := s.listThreads(ctx, userID, sel.withQuery(s.protection.exclusion()), maxThreads)
+	if err != nil {
+		return nil, err
+	}
+	report.Threads = len(threads)
+
+	for _, t := range threads {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		msgs, err := s.gmail.GetThreadAttachments(ctx, userID, t.Id)
+		if err != nil {
+			logger.L().Warn("Failed to inspect thread attachments",
+				zap.String("thread_id", t.Id),
+				zap.Error(err),
+			)
+			report.Failed = append(report.Failed, &FailedThread{
+				ThreadID: t.Id,
+				Reason:   err.Error(),
+				Code:     gmail.Code(err),
+			})
+			continue
+		}
+		for _, m := range msgs {
+			if m.SizeEstimate < minSize {
+				continue
+			}
+			report.Messages = append(report.Messages, m)
+			report.TotalSizeBytes += m.SizeEstimate
+		}
+	}
+	sort.SliceStable(report.Messages, func(i, j int) bool {
+		return report.Messages[i].SizeEstimate > report.Messages[j].SizeEstimate
+	})
+
+	logger.L().Info("Reported large attachments",
+		zap.String("user_id", userID),
+		zap.String("query", report.Query),
+		zap.Int("thread_count", report.Threads),
+		zap.Int("message_count", len(report.Messages)),
+		zap.Int64("total_size_bytes", report.TotalSizeBytes),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return report, nil
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/internal/backup"
+	"mailcleanerpro/internal/rules"
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// cleanRun holds what a cleanup run saves before it removes threads.
+type cleanRun struct {
+	backup      *runBackup
+	attachments *runAttachments
+}
+
+// newCleanRun prepares the backups requested by opts, named after runID. Dry
+// runs save nothing.
+func (s *CleanerService) newCleanRun(opts *CleanOptions, runID string) *cleanRun {
+	run := &cleanRun{}
+	if opts.DryRun {
+		return run
+	}
+	run.backup = newRunBackup(opts.Backup, s.backupDir, runID)
+	if opts.SaveAttachments {
+		run.attachments = &runAttachments{
+			opts: backup.Options{Dir: s.backupDir},
+			name: runID + "_attachments",
+		}
+	}
+	return run
+}
+
+// preserve saves the attachments of threads op trashes or deletes, and backs
+// up threads op permanently deletes, as requested for the run. Err is set on
+// each of threads that could not be saved, so that op leaves it alone.
+func (r *cleanRun) preserve(ctx context.Context, g *gmail.Service, userID string, op rules.Operation, threads []*gmail.ThreadResult) {
+	if r.attachments != nil && op.Destructive() {
+		threads = r.attachments.threads(ctx, g, userID, threads)
+	}
+	if r.backup != nil && op.Action == rules.ActionDelete {
+		r.backup.threads(ctx, g, userID, threads)
+	}
+}
+
+// runBackup backs up the threads a cleanup run permanently deletes. The
+// archive is only created once there is something to back up.
+type runBackup struct {
+	opts    backup.Options
+	name    string
+	archive backup.Archive
+}
+
+// newRunBackup returns nil when opts is nil. The archive is named name, and
+// written to dir unless opts sets its own.
+func newRunBackup(opts *backup.Options, dir, name string) *runBackup {
+	if opts == nil {
+		return nil
+	}
+	b := &runBackup{opts: *opts, name: name}
+	if b.opts.Dir == "" {
+		b.opts.Dir = dir
+	}
+	return b
+}
+
+// path returns where the backup was written, or "" if nothing was backed up.
+func (b *runBackup) path() string {
+	if b == nil || b.archive == nil {
+		return ""
+	}
+	return b.archive.Path()
+}
+
+func (b *runBackup) close() error {
+	if b == nil || b.archive == nil {
+		return nil
+	}
+	return b.archive.Close()
+}
+
+// threads writes the messages of threads to the archive: exactly those listed
+// in MessageIDs, which are the ones about to be deleted. It returns the
+// threads that were backed up in full, and sets Err on each thread that was
+// not; those must not be deleted.
+func (b *runBackup) threads(ctx context.Context, g *gmail.Service, userID string, threads []*gmail.ThreadResult) []*gmail.ThreadResult {
+	var saved []*gmail.ThreadResult
+	fail := func(tr *gmail.ThreadResult, err error) {
+		tr.Err = fmt.Errorf("backup failed: %w", err)
+	}
+
+	if b.archive == nil && len(threads) > 0 {
+		archive, err := backup.Create(b.opts, b.name)
+		if err != nil {
+			for _, tr := range threads {
+				fail(tr, err)
+			}
+			return nil
+		}
+		b.archive = archive
+		logger.L().Info("Created backup archive",
+			zap.String("path", archive.Path()),
+			zap.String("format", string(b.opts.Format)),
+		)
+	}
+
+	for i, tr := range threads {
+		if err := ctx.Err(); err != nil {
+			fail(tr, err)
+			continue
+		}
+		var err error
+		for _, id := range tr.MessageIDs {
+			var m *gmail.RawMessage
+			if m, err = g.GetRawMessage(ctx, userID, id); err != nil {
+				break
+			}
+			if err = b.archive.Add(m.ID, m.InternalDate, m.Raw); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.L().Warn("Failed to back up thread; it will not be deleted",
+				zap.String("thread_id", tr.ThreadID),
+				zap.Error(err),
+			)
+			fail(tr, err)
+			continue
+		}
+		saved = append(saved, tr)
+		gmail.ReportProgress(ctx, gmail.ProgressEvent{
+			Type:      gmail.EventBatchProgress,
+			Operation: "backup",
+			Done:      i + 1,
+			Total:     len(threads),
+		})
+	}
+	return saved
+}
+
+// runAttachments saves the attachments of the threads a cleanup run trashes
+// or deletes. The directory is only created once there is something to save.
+type runAttachments struct {
+	opts  backup.Options
+	name  string
+	dir   *backup.AttachmentDir
+	saved int
+}
+
+// path returns where attachments were saved, or "" if none were.
+func (a *runAttachments) path() string {
+	if a == nil || a.dir == nil {
+		return ""
+	}
+	return a.dir.Path()
+}
+
+// count returns the number of attachments saved.
+func (a *runAttachments) count() int {
+	if a == nil {
+		return 0
+	}
+	return a.saved
+}
+
+// threads saves the attachments of the messages of threads listed in
+// MessageIDs, which are the ones about to be removed. It returns the threads whose
+// attachments were all saved, and sets Err on each thread whose were not;
+// those must not be removed.
+func (a *runAttachments) threads(ctx context.Context, g *gmail.Service, userID string, threads []*gmail.ThreadResult) []*gmail.ThreadResult {
+	var saved []*gmail.ThreadResult
+	fail := func(tr *gmail.ThreadResult, err error) {
+		tr.Err = fmt.Errorf("saving attachments failed: %w", err)
+	}
+
+	for i, tr := range threads {
+		if err := ctx.Err(); err != nil {
+			fail(tr, err)
+			continue
+		}
+		if err := a.thread(ctx, g, userID, tr); err != nil {
+			logger.L().Warn("Failed to save thread attachments; it will not be removed",
+				zap.String("thread_id", tr.ThreadID),
+				zap.Error(err),
+			)
+			fail(tr, err)
+			continue
+		}
+		saved = append(saved, tr)
+		gmail.ReportProgress(ctx, gmail.ProgressEvent{
+			Type:      gmail.EventBatchProgress,
+			Operation: "save_attachments",
+			Done:      i + 1,
+			Total:     len(threads),
+		})
+	}
+	return saved
+}
+
+func (a *runAttachments) thread(ctx context.Context, g *gmail.Service, userID string, tr *gmail.ThreadResult) error {
+	all, err := g.GetThreadAttachments(ctx, userID, tr.ThreadID)
+	if err != nil {
+		return err
+	}
+	removed := make(map[string]bool, len(tr.MessageIDs))
+	for _, id := range tr.MessageIDs {
+		removed[id] = true
+	}
+	var msgs []*gmail.MessageAttachments
+	for _, m := range all {
+		if removed[m.MessageID] {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if a.dir == nil {
+		if a.dir, err = backup.CreateAttachmentDir(a.opts, a.name); err != nil {
+			return err
+		}
+		logger.L().Info("Created attachment directory", zap.String("path", a.dir.Path()))
+	}
+	for _, m := range msgs {
+		for _, att := range m.Attachments {
+			data, err := g.GetAttachment(ctx, userID, m.MessageID, att)
+			if err != nil {
+				return err
+			}
+			if err := a.dir.Add(m.MessageID, att.Filename, data); err != nil {
+				return err
+			}
+			a.saved++
+		}
+	}
+	return nil
+}
@@ -2,9 +2,13 @@ package service
 
 import (
 	"context"
-	"strings"
+	"fmt"
 	"time"
 
+	"mailcleanerpro/internal/backup"
+	"mailcleanerpro/internal/ids"
+	"mailcleanerpro/internal/journal"
+	"mailcleanerpro/internal/rules"
 	"mailcleanerpro/pkg/gmail"
 	"mailcleanerpro/pkg/logger"
 
@@ -12,51 +16,326 @@ import (
 	gmailv1 "google.golang.org/api/gmail/v1"
 )
 
-// IsAuthError checks if an error is related to authentication or authorization
-func IsAuthError(err error) bool {
-	if err == nil {
-		return false
+type CleanerService struct {
+	gmail      *gmail.Service
+	protection *Protection
+	journal    *journal.Store
+	// backupDir is where backups are written when CleanOptions.Backup has no Dir.
+	backupDir string
+}
+
+// DefaultPreviewSampleSize is the number of threads described per selection in a
+// dry run when CleanOptions.SampleSize is not set.
+const DefaultPreviewSampleSize = 10
+
+type CleanSummary struct {
+	PerCategoryDeleted map[string]int               `json:"per_category_deleted"`
+	TotalDeleted       int                          `json:"total_deleted"`
+	TotalFailed        int                          `json:"total_failed"`
+	TotalSkipped       int                          `json:"total_skipped"`
+	TotalModified      int                          `json:"total_modified"`
+	Results            map[string]*SelectionResult  `json:"results"`
+	Completed          bool                         `json:"completed"`
+	Reason             string                       `json:"reason"`
+	DryRun             bool                         `json:"dry_run"`
+	Preview            map[string]*SelectionPreview `json:"preview,omitempty"`
+	// Rules reports the outcome of each cleanup rule, keyed by rule name.
+	// TotalModified counts the threads rules archived, labelled or marked read.
+	Rules map[string]*SelectionResult `json:"rules,omitempty"`
+	// Retries is the number of Gmail API calls that were retried during the run.
+	Retries int64 `json:"retries"`
+	// RunID identifies the run's journal, used to undo it.
+	RunID string `json:"run_id,omitempty"`
+	// BackupPath is the mbox file or EML directory permanently deleted
+	// messages were backed up to.
+	BackupPath string `json:"backup_path,omitempty"`
+	// AttachmentsPath is the directory the attachments of trashed and deleted
+	// threads were saved to, and AttachmentsSaved the number saved.
+	AttachmentsPath  string `json:"attachments_path,omitempty"`
+	AttachmentsSaved int    `json:"attachments_saved,omitempty"`
+}
+
+// SelectionResult is the outcome of a cleanup run for one selection.
+type SelectionResult struct {
+	// Action and Matched are only set for the results of cleanup rules.
+	Action        rules.Action    `json:"action,omitempty"`
+	Matched       int             `json:"matched,omitempty"`
+	Succeeded     int             `json:"succeeded"`
+	Failed        int             `json:"failed"`
+	FailedThreads []*FailedThread `json:"failed_threads,omitempty"`
+	// Skipped is the number of protected threads left alone, and
+	// SkippedReasons breaks it down by protection rule. A thread matching
+	// several rules is counted once in Skipped but under every rule. Threads
+	// excluded by the selection's query are counted from Gmail's estimates.
+	Skipped        int            `json:"skipped"`
+	SkippedReasons map[string]int `json:"skipped_reasons,omitempty"`
+	// Error is set when the selection could not be processed in full.
+	Error string `json:"error,omitempty"`
+}
+
+// FailedThread records a thread that could not be processed and why.
+type FailedThread struct {
+	ThreadID string `json:"thread_id"`
+	// MessageID is set when only this message of the thread was affected.
+	MessageID string `json:"message_id,omitempty"`
+	Reason    string `json:"reason"`
+	// Code is the Gmail error code of the failure, if it was a Gmail API error.
+	Code string `json:"code,omitempty"`
+}
+
+// ErrorPolicy decides what a cleanup run does when a selection fails.
+type ErrorPolicy string
+
+const (
+	// ErrorPolicyStop ends the run at the first failure. It is the default.
+	ErrorPolicyStop ErrorPolicy = "stop"
+	// ErrorPolicyContinue records failures and carries on with the rest of the run.
+	ErrorPolicyContinue ErrorPolicy = "continue"
+)
+
+// SelectionPreview describes what a cleanup run would do to one selection.
+type SelectionPreview struct {
+	Matched   int                     `json:"matched"`
+	Permanent bool                    `json:"permanent"`
+	Samples   []*gmail.ThreadMetadata `json:"samples"`
+}
+
+// Selection identifies a set of threads to clean: a Gmail label, a Gmail
+// search query, or a label narrowed down by a query. Name is the key the
+// selection's results are reported under.
+type Selection struct {
+	Name    string `json:"name"`
+	LabelID string `json:"label_id,omitempty"`
+	Query   string `json:"query,omitempty"`
+}
+
+// permanent reports whether threads in the selection are deleted permanently
+// rather than moved to trash.
+func (sel Selection) permanent() bool { return sel.LabelID == "TRASH" }
+
+func (sel Selection) labelIDs() []string {
+	if sel.LabelID == "" {
+		return nil
 	}
-	errorStr := err.Error()
-	return strings.Contains(errorStr, "ACCESS_TOKEN_SCOPE_INSUFFICIENT") ||
-		strings.Contains(errorStr, "insufficientPermissions") ||
-		strings.Contains(errorStr, "Error 401") ||
-		strings.Contains(errorStr, "Error 403")
+	return []string{sel.LabelID}
 }
 
-type CleanerService struct {
-	gmail *gmail.Service
+// CleanOptions describes which threads a cleanup run should select.
+type CleanOptions struct {
+	// Categories are Gmail label IDs, e.g. CATEGORY_PROMOTIONS or TRASH.
+	Categories []string
+	// Query is a Gmail search query. On its own it forms a single selection;
+	// combined with Categories it narrows every category down.
+	Query string
+	// Retention, if set, replaces Categories and Query with the selections
+	// compiled from the policy's rules.
+	Retention *RetentionPolicy
+	// Rules, if set, decide per thread what happens to it instead of the
+	// default trash or delete. Without Categories or Query, rules are
+	// evaluated against the whole mailbox.
+	Rules *rules.Set
+	// Action, if set, is applied to every selected thread. By default threads
+	// selected from TRASH are permanently deleted and others are trashed.
+	Action         *rules.Operation
+	MaxPerCategory int64
+	// DryRun lists and describes the selected threads without modifying them.
+	DryRun bool
+	// SampleSize is the number of threads per selection described in a dry run.
+	SampleSize int
+	// RunID names the journal the run's changes are recorded in. A random ID
+	// is used when empty.
+	RunID string
+	// OnError decides whether the run stops at the first failure or carries on.
+	// It defaults to ErrorPolicyStop.
+	OnError ErrorPolicy
+	// Backup, if set, saves the raw messages of threads before they are
+	// permanently deleted. Threads that cannot be backed up are not deleted.
+	Backup *backup.Options
+	// SaveAttachments saves the attachments of threads before they are trashed
+	// or deleted. Threads whose attachments cannot be saved are left alone.
+	SaveAttachments bool
+	// Progress, if set, receives progress events for the run, including the
+	// page and batch events reported by the Gmail client.
+	Progress gmail.ProgressFunc
 }
 
-type CleanSummary struct {
-	PerCategoryDeleted map[string]int `json:"per_category_deleted"`
-	TotalDeleted       int            `json:"total_deleted"`
-	Completed          bool           `json:"completed"`
-	Reason             string         `json:"reason"`
+// operation returns the operation applied to threads in sel when no rules are set.
+func (o *CleanOptions) operation(sel Selection) rules.Operation {
+	switch {
+	case o.Action != nil:
+		return *o.Action
+	case sel.permanent():
+		return rules.Operation{Action: rules.ActionDelete}
+	default:
+		return rules.Operation{Action: rules.ActionTrash}
+	}
+}
+
+func (o *CleanOptions) errorPolicy() ErrorPolicy {
+	if o.OnError == "" {
+		return ErrorPolicyStop
+	}
+	return o.OnError
+}
+
+// selectionContext returns a context whose progress events are tagged with
+// the selection's name.
+func (o *CleanOptions) selectionContext(ctx context.Context, sel Selection) context.Context {
+	if o.Progress == nil {
+		return ctx
+	}
+	report := o.Progress
+	return gmail.WithProgress(ctx, func(e gmail.ProgressEvent) {
+		e.Selection = sel.Name
+		report(e)
+	})
+}
+
+// Selections expands the options into the selections to process, in order.
+func (o *CleanOptions) Selections() []Selection {
+	if o.Retention != nil {
+		return o.Retention.Selections()
+	}
+	if len(o.Categories) == 0 {
+		if o.Query == "" {
+			if o.Rules != nil {
+				return []Selection{{Name: "all"}}
+			}
+			return nil
+		}
+		return []Selection{{Name: o.Query, Query: o.Query}}
+	}
+	sels := make([]Selection, 0, len(o.Categories))
+	for _, label := range o.Categories {
+		sels = append(sels, Selection{Name: label, LabelID: label, Query: o.Query})
+	}
+	return sels
 }
 
-func NewCleanerService(g *gmail.Service) *CleanerService {
-	return &CleanerService{gmail: g}
+// NewCleanerService creates a CleanerService. Threads matching protection are
+// never cleaned; a nil protection uses DefaultProtection. Changes are recorded
+// in journal so they can be undone; a nil journal records nothing. Backups are
+// written to backupDir, or backup.DefaultDir when it is empty.
+func NewCleanerService(g *gmail.Service, protection *Protection, journal *journal.Store, backupDir string) *CleanerService {
+	if protection == nil {
+		protection = DefaultProtection()
+	}
+	return &CleanerService{gmail: g, protection: protection, journal: journal, backupDir: backupDir}
 }
 
 // CleanCategories identifies and removes emails in specified categories.
 // categories should be Gmail label IDs: [CATEGORY_SOCIAL, CATEGORY_FORUMS, CATEGORY_PROMOTIONS, CATEGORY_UPDATES, TRASH]
 // Regular categories are moved to trash, TRASH category emails are permanently deleted
 func (s *CleanerService) CleanCategories(ctx context.Context, userID string, categories []string, maxPerCat int64) (*CleanSummary, error) {
+	return s.Clean(ctx, userID, &CleanOptions{Categories: categories, MaxPerCategory: maxPerCat})
+}
+
+// Clean removes the threads selected by opts. Threads selected from TRASH are
+// permanently deleted; everything else is moved to trash. Protected threads are
+// skipped and counted in the summary.
+//
+// When a selection fails, the returned summary records everything processed up
+// to that point alongside the error. With ErrorPolicyContinue, failures are
+// recorded in the summary and the run carries on; the error is then nil unless
+// the context was cancelled.
+func (s *CleanerService) Clean(ctx context.Context, userID string, opts *CleanOptions) (*CleanSummary, error) {
+	selections := opts.Selections()
+	maxPerCat := opts.MaxPerCategory
+
 	// Log operation start
 	start := time.Now()
+	retriesBefore := s.gmail.Retries()
 	logger.L().Info("Starting email cleanup operation",
 		zap.String("user_id", userID),
-		zap.Strings("categories", categories),
+		zap.Strings("categories", opts.Categories),
+		zap.String("query", opts.Query),
 		zap.Int64("max_per_category", maxPerCat),
+		zap.Bool("dry_run", opts.DryRun),
+		zap.String("on_error", string(opts.errorPolicy())),
 	)
 
-	result := make(map[string]int)
-	total := 0
-	completed := true
-	reason := "all categories processed"
+	if err := s.CheckAccess(opts); err != nil {
+		return nil, err
+	}
+	if err := s.checkLabels(ctx, userID, opts); err != nil {
+		return nil, err
+	}
+
+	exclusion := s.protection.exclusion()
+	summary := &CleanSummary{
+		PerCategoryDeleted: make(map[string]int),
+		Results:            make(map[string]*SelectionResult),
+		Completed:          true,
+		Reason:             "all categories processed",
+		DryRun:             opts.DryRun,
+	}
+	runID := opts.RunID
+	if !opts.DryRun && runID == "" {
+		var err error
+		if runID, err = ids.New(); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.DryRun && s.journal != nil {
+		summary.RunID = runID
+	}
+	if opts.DryRun {
+		summary.Preview = make(map[string]*SelectionPreview)
+		summary.Completed = false
+		summary.Reason = "dry run; no emails were modified"
+	}
+	run := s.newCleanRun(opts, runID)
+
+	// finish logs the outcome of the run and returns the summary with err.
+	finish := func(err error) (*CleanSummary, error) {
+		summary.Retries = s.gmail.Retries() - retriesBefore
+		summary.BackupPath = run.backup.path()
+		summary.AttachmentsPath = run.attachments.path()
+		summary.AttachmentsSaved = run.attachments.count()
+		if cerr := run.backup.close(); cerr != nil {
+			// Each message is flushed and synced to disk as it is written,
+			// before anything is deleted, so only the archive's trailer
+			// may be missing.
+			logger.L().Error("Failed to close backup archive",
+				zap.String("path", summary.BackupPath),
+				zap.Error(cerr),
+			)
+		}
+		logger.L().Info("Email cleanup operation completed",
+			zap.String("user_id", userID),
+			zap.Int("total_deleted", summary.TotalDeleted),
+			zap.Int("total_failed", summary.TotalFailed),
+			zap.Int("total_skipped", summary.TotalSkipped),
+			zap.Bool("completed", summary.Completed),
+			zap.String("reason", summary.Reason),
+			zap.Duration("total_duration", time.Since(start)),
+			zap.Any("per_category_results", summary.PerCategoryDeleted),
+			zap.Int("categories_processed", len(summary.Results)),
+			zap.Int64("retries", summary.Retries),
+			zap.String("run_id", summary.RunID),
+			zap.String("backup_path", summary.BackupPath),
+			zap.Error(err),
+		)
+		return summary, err
+	}
+
+	for i, sel := range selections {
+		if err := ctx.Err(); err != nil {
+			summary.Completed = false
+			summary.Reason = "cancelled"
+			return finish(err)
+		}
+
+		label := sel.Name
+		ctx := opts.selectionContext(ctx, sel)
+		gmail.ReportProgress(ctx, gmail.ProgressEvent{
+			Type:  gmail.EventSelectionStarted,
+			Done:  i,
+			Total: len(selections),
+		})
+		res := &SelectionResult{}
+		summary.Results[label] = res
 
-	for _, label := range categories {
 		// Log category processing start
 		categoryStart := time.Now()
 		logger.L().Debug("Processing category",
@@ -64,15 +343,12 @@ func (s *CleanerService) CleanCategories(ctx context.Context, userID string, cat
 			zap.String("user_id", userID),
 		)
 
-		var threads []*gmailv1.Thread
-		var err error
-
-		// Handle TRASH category differently
-		if label == "TRASH" {
-			threads, err = s.gmail.ListTrashThreads(ctx, userID, maxPerCat)
-		} else {
-			threads, err = s.gmail.ListCategoryThreads(ctx, userID, label, maxPerCat)
+		op := opts.operation(sel)
+		scope := sel
+		if opts.Rules == nil {
+			scope = sel.withQuery(narrowing(op))
 		}
+		threads, err := s.listThreads(ctx, userID, scope.withQuery(exclusion), maxPerCat)
 
 		// Log query result
 		logger.L().Debug("Category query completed",
@@ -87,85 +363,265 @@ func (s *CleanerService) CleanCategories(ctx context.Context, userID string, cat
 				zap.String("user_id", userID),
 				zap.Error(err),
 			)
-			return nil, err
+			res.Error = err.Error()
+			summary.Completed = false
+			if opts.errorPolicy() == ErrorPolicyStop || ctx.Err() != nil {
+				summary.Reason = fmt.Sprintf("stopped: failed to list threads in %s", label)
+				return finish(err)
+			}
+			summary.Reason = "one or more categories could not be processed"
+			continue
 		}
 		ids := make([]string, 0, len(threads))
 		for _, t := range threads {
 			ids = append(ids, t.Id)
 		}
+		s.estimateSkipped(ctx, userID, scope, maxPerCat, res)
+		summary.TotalSkipped += res.Skipped
 
-		// For TRASH category, delete permanently; for other categories, move to trash
-		if label == "TRASH" {
-			err = s.gmail.BatchDeleteThreadsPermanently(ctx, userID, ids)
+		if opts.Rules != nil {
+			err = s.applyRules(ctx, userID, sel, ids, opts, summary, res, run)
+			summary.TotalFailed += res.Failed
+			if err != nil {
+				logger.L().Error("Failed to apply cleanup rules",
+					zap.String("category", label),
+					zap.String("user_id", userID),
+					zap.Int("thread_count", len(ids)),
+					zap.Int("failed_count", res.Failed),
+					zap.Error(err),
+				)
+				res.Error = err.Error()
+				summary.Completed = false
+				if opts.errorPolicy() == ErrorPolicyStop || ctx.Err() != nil {
+					summary.Reason = fmt.Sprintf("stopped: failed to apply rules in %s", label)
+					return finish(err)
+				}
+				summary.Reason = "some threads could not be processed"
+			}
+			gmail.ReportProgress(ctx, gmail.ProgressEvent{
+				Type:  gmail.EventSelectionFinished,
+				Done:  res.Succeeded,
+				Total: len(ids),
+			})
+			// Threads that match no rule stay put, so only the listing limit
+			// tells whether more threads remain to be evaluated.
+			if err == nil && int64(len(ids)) >= maxPerCat {
+				summary.Completed = false
+				summary.Reason = "max per category reached; more emails may remain"
+			}
+			continue
+		}
+
+		if opts.DryRun {
+			summary.Preview[label] = s.previewSelection(ctx, userID, sel, op.Action == rules.ActionDelete, ids, opts.SampleSize)
+			gmail.ReportProgress(ctx, gmail.ProgressEvent{
+				Type:  gmail.EventSelectionFinished,
+				Total: len(ids),
+			})
+			continue
+		}
+
+		batch, err := s.applyOperation(ctx, userID, op, ids, run)
+		s.journalBatch(ctx, userID, summary.RunID, op, batch)
+		summary.TotalSkipped += res.addSkipped(batch)
+		processed := len(batch.Succeeded())
+		res.Action = op.Action
+		res.Succeeded = processed
+		for _, tr := range batch.Failed() {
+			res.FailedThreads = append(res.FailedThreads, &FailedThread{
+				ThreadID: tr.ThreadID,
+				Reason:   tr.Err.Error(),
+				Code:     gmail.Code(tr.Err),
+			})
+		}
+		res.Failed = len(res.FailedThreads)
+		if op.Destructive() {
+			summary.PerCategoryDeleted[label] = processed
+			summary.TotalDeleted += processed
 		} else {
-			err = s.gmail.BatchTrashThreads(ctx, userID, ids)
+			summary.TotalModified += processed
 		}
+		summary.TotalFailed += res.Failed
+
 		if err != nil {
-			logger.L().Error("Failed to delete/trash threads",
+			logger.L().Error("Failed to process threads",
 				zap.String("category", label),
 				zap.String("user_id", userID),
+				zap.String("action", string(op.Action)),
 				zap.Int("thread_count", len(ids)),
-				zap.Bool("permanent_delete", label == "TRASH"),
+				zap.Int("succeeded_count", processed),
+				zap.Int("failed_count", res.Failed),
 				zap.Error(err),
 			)
-			return nil, err
+			res.Error = err.Error()
+			summary.Completed = false
+			if opts.errorPolicy() == ErrorPolicyStop || ctx.Err() != nil {
+				summary.Reason = fmt.Sprintf("stopped: failed to process threads in %s", label)
+				return finish(err)
+			}
+			summary.Reason = "some threads could not be processed"
 		}
-		deleted := len(ids)
 
-		// Log successful deletion
+		// Log successful processing
 		logger.L().Info("Successfully processed threads",
 			zap.String("category", label),
-			zap.Int("deleted_count", deleted),
-			zap.Bool("permanent_delete", label == "TRASH"),
+			zap.String("action", string(op.Action)),
+			zap.Int("processed_count", processed),
+			zap.Int("failed_count", res.Failed),
 		)
-		result[label] = deleted
-		total += deleted
+		gmail.ReportProgress(ctx, gmail.ProgressEvent{
+			Type:  gmail.EventSelectionFinished,
+			Done:  processed,
+			Total: len(ids),
+		})
+		if err != nil {
+			continue
+		}
 
 		// Determine if we reached the per-category max threshold or there are no more emails
-		if int64(deleted) >= maxPerCat {
-			completed = false
-			reason = "max per category reached; more emails may remain"
-		} else {
-			var estimate int64
-			if label == "TRASH" {
-				estimate, err = s.gmail.EstimateTrashThreads(ctx, userID)
-			} else {
-				estimate, err = s.gmail.EstimateCategoryThreads(ctx, userID, label)
-			}
+		switch {
+		case int64(len(ids)) >= maxPerCat:
+			summary.Completed = false
+			summary.Reason = "max per category reached; more emails may remain"
+		case !op.Destructive() && narrowing(op) == "":
+			// Labelled threads still match the selection, so Gmail's
+			// estimate cannot tell whether any remain.
+		default:
+			estimate, err := s.estimateThreads(ctx, userID, scope.withQuery(exclusion))
 			if err == nil && estimate > 0 {
 				// There are still emails, so overall not fully completed
-				completed = false
-				reason = "remaining emails detected in one or more categories"
+				summary.Completed = false
+				summary.Reason = "remaining emails detected in one or more categories"
 			}
 		}
+	}
 
-		// Log API quota management
-		logger.L().Debug("API quota pause",
-			zap.String("category", label),
-			zap.Int("deleted_count", deleted),
-			zap.Duration("pause_duration", 200*time.Millisecond),
-		)
+	return finish(nil)
+}
+
+// estimateSkipped records in res Gmail's estimate of how many threads in sel
+// are protected, capped at max, and by which rules. It costs one threads.list
+// page per rule rather than listing the protected threads. Failures are logged
+// and leave the counts short.
+func (s *CleanerService) estimateSkipped(ctx context.Context, userID string, sel Selection, max int64, res *SelectionResult) {
+	protected := s.protection.rules()
+	if len(protected) == 0 {
+		return
+	}
+	// Counting is not part of the run's progress.
+	ctx = gmail.WithProgress(ctx, nil)
+	estimate := func(sel Selection) (int64, bool) {
+		n, err := s.estimateThreads(ctx, userID, sel)
+		if err != nil {
+			logger.L().Warn("Failed to estimate protected threads",
+				zap.String("category", sel.Name),
+				zap.String("query", sel.Query),
+				zap.Error(err),
+			)
+			return 0, false
+		}
+		return min(n, max), true
+	}
 
-		// small pause to respect API quotas
-		time.Sleep(200 * time.Millisecond)
+	for _, rule := range protected {
+		if n, ok := estimate(sel.withQuery(rule.Term)); ok && n > 0 {
+			if res.SkippedReasons == nil {
+				res.SkippedReasons = make(map[string]int)
+			}
+			res.SkippedReasons[rule.Reason] = int(n)
+		}
 	}
+	if len(res.SkippedReasons) == 0 {
+		return
+	}
+	all, ok := estimate(sel)
+	if !ok {
+		return
+	}
+	unprotected, ok := estimate(sel.withQuery(s.protection.exclusion()))
+	if !ok || all <= unprotected {
+		return
+	}
+	res.Skipped = int(all - unprotected)
 
-	// Log operation completion
-	duration := time.Since(start)
-	logger.L().Info("Email cleanup operation completed",
-		zap.String("user_id", userID),
-		zap.Int("total_deleted", total),
-		zap.Bool("completed", completed),
-		zap.String("reason", reason),
-		zap.Duration("total_duration", duration),
-		zap.Any("per_category_results", result),
-		zap.Int("categories_processed", len(categories)),
+	logger.L().Info("Skipped protected threads",
+		zap.String("category", sel.Name),
+		zap.Int("skipped_count", res.Skipped),
+		zap.Any("skipped_reasons", res.SkippedReasons),
 	)
+}
 
-	return &CleanSummary{
-		PerCategoryDeleted: result,
-		TotalDeleted:       total,
-		Completed:          completed,
-		Reason:             reason,
-	}, nil
+// addSkipped counts the threads batch skipped as protected and returns how many
+// it added to r.Skipped. These are threads the selection's query could not
+// exclude, so they are not part of the estimate made by estimateSkipped.
+func (r *SelectionResult) addSkipped(batch *gmail.BatchResult) int {
+	skipped := batch.Skipped()
+	for _, tr := range skipped {
+		if r.SkippedReasons == nil {
+			r.SkippedReasons = make(map[string]int)
+		}
+		r.SkippedReasons[tr.Skipped]++
+	}
+	r.Skipped += len(skipped)
+	return len(skipped)
+}
+
+// previewSelection describes the threads a run would process for sel without
+// touching them. Metadata failures are logged and leave the sample short.
+func (s *CleanerService) previewSelection(ctx context.Context, userID string, sel Selection, permanent bool, ids []string, sampleSize int) *SelectionPreview {
+	if sampleSize <= 0 {
+		sampleSize = DefaultPreviewSampleSize
+	}
+	p := &SelectionPreview{
+		Matched:   len(ids),
+		Permanent: permanent,
+		Samples:   make([]*gmail.ThreadMetadata, 0, sampleSize),
+	}
+	for _, id := range ids {
+		if len(p.Samples) >= sampleSize {
+			break
+		}
+		meta, err := s.gmail.GetThreadMetadata(ctx, userID, id)
+		if err != nil {
+			logger.L().Warn("Failed to fetch thread metadata for preview",
+				zap.String("category", sel.Name),
+				zap.String("thread_id", id),
+				zap.Error(err),
+			)
+			continue
+		}
+		p.Samples = append(p.Samples, meta)
+	}
+
+	logger.L().Info("Previewed category threads",
+		zap.String("category", sel.Name),
+		zap.Int("matched_count", p.Matched),
+		zap.Int("sample_count", len(p.Samples)),
+		zap.Bool("permanent_delete", p.Permanent),
+	)
+	return p
+}
+
+// listThreads lists up to max threads for a selection.
+func (s *CleanerService) listThreads(ctx context.Context, userID string, sel Selection, max int64) ([]*gmailv1.Thread, error) {
+	switch {
+	case sel.Query != "" || sel.LabelID == "":
+		return s.gmail.ListThreadsByQuery(ctx, userID, sel.Query, max, sel.labelIDs()...)
+	case sel.LabelID == "TRASH":
+		return s.gmail.ListTrashThreads(ctx, userID, max)
+	default:
+		return s.gmail.ListCategoryThreads(ctx, userID, sel.LabelID, max)
+	}
+}
+
+// estimateThreads returns Gmail's estimate of the threads left in a selection.
+func (s *CleanerService) estimateThreads(ctx context.Context, userID string, sel Selection) (int64, error) {
+	switch {
+	case sel.Query != "" || sel.LabelID == "":
+		return s.gmail.EstimateQueryThreads(ctx, userID, sel.Query, sel.labelIDs()...)
+	case sel.LabelID == "TRASH":
+		return s.gmail.EstimateTrashThreads(ctx, userID)
+	default:
+		return s.gmail.EstimateCategoryThreads(ctx, userID, sel.LabelID)
+	}
 }
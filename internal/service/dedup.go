@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/internal/ids"
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// defaultDedupQuery scans all mail outside spam and trash.
+const defaultDedupQuery = "-in:spam -in:trash"
+
+// DedupKeep decides which copy of a duplicated message is kept.
+type DedupKeep string
+
+const (
+	// KeepOldest keeps the copy Gmail received first. It is the default.
+	KeepOldest DedupKeep = "oldest"
+	// KeepNewest keeps the copy Gmail received last.
+	KeepNewest DedupKeep = "newest"
+)
+
+// DedupOptions selects the messages searched for duplicates.
+type DedupOptions struct {
+	// Query is a Gmail search query; by default all mail outside spam and
+	// trash is searched.
+	Query string
+	// MaxMessages caps the number of messages scanned.
+	MaxMessages int64
+	Keep        DedupKeep
+	// DryRun reports duplicates without trashing them.
+	DryRun bool
+	// SampleSize is the number of duplicate groups described in the summary.
+	SampleSize int
+	// RunID names the journal the trashed messages are recorded in. A random
+	// ID is used when empty.
+	RunID string
+	// Progress, if set, receives the page and batch events reported by the
+	// Gmail client.
+	Progress gmail.ProgressFunc
+}
+
+// DuplicateGroup describes copies of one message.
+type DuplicateGroup struct {
+	// Key is "message-id:<Message-ID>" or, for messages without one,
+	// "hash:<digest of sender, subject, date and size>".
+	Key     string `json:"key"`
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+	// Kept is the Gmail ID of the copy kept; Duplicates are the others.
+	Kept       string   `json:"kept"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// DedupSummary reports the outcome of a dedup pass.
+type DedupSummary struct {
+	// RunID identifies the run's journal, used to undo it.
+	RunID   string `json:"run_id,omitempty"`
+	Query   string `json:"query"`
+	Scanned int    `json:"scanned"`
+	// Failed counts messages whose metadata could not be fetched.
+	Failed     int  `json:"failed"`
+	Truncated  bool `json:"truncated"`
+	Groups     int  `json:"groups"`
+	Duplicates int  `json:"duplicates"`
+	// Skipped counts duplicates left alone because they are protected, and
+	// SkippedReasons breaks it down by protection rule.
+	Skipped        int            `json:"skipped"`
+	SkippedReasons map[string]int `json:"skipped_reasons,omitempty"`
+	Trashed        int            `json:"trashed"`
+	DryRun         bool           `json:"dry_run"`
+	// Samples describes up to SampleSize duplicate groups, largest first.
+	Samples []*DuplicateGroup `json:"samples"`
+	// Error is set when trashing the duplicates failed part-way.
+	Error string `json:"error,omitempty"`
+}
+
+// CheckDedupAccess reports whether the granted Gmail access allows a dedup
+// run with opts, so that a background run can be refused before it starts.
+func (s *CleanerService) CheckDedupAccess(opts *DedupOptions) error {
+	if opts.DryRun {
+		return s.gmail.Require(gmail.AccessReadOnly)
+	}
+	return s.gmail.Require(gmail.AccessModify)
+}
+
+// dedupKey returns the key grouping copies of m: its Message-ID header or,
+// without one, a hash of its sender, subject, Date header and size.
+func dedupKey(m *gmail.MessageMetadata) string {
+	if id := strings.Trim(strings.TrimSpace(m.MessageIDHeader), "<>"); id != "" {
+		return "message-id:" + id
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d",
+		strings.ToLower(strings.TrimSpace(m.From)),
+		strings.TrimSpace(m.Subject),
+		strings.TrimSpace(m.DateHeader),
+		m.SizeEstimate,
+	)
+	return "hash:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Dedup finds messages occurring more than once in the selection of opts and
+// moves all but one copy of each to trash. Copies are grouped by Message-ID
+// header, falling back to a hash of sender, subject, date and size. Protected
+// messages are left out of the search, and duplicates found protected by their
+// labels and sender are skipped rather than trashed. Trashed messages are
+// journaled under the run ID so the run can be undone.
+func (s *CleanerService) Dedup(ctx context.Context, userID string, opts *DedupOptions) (*DedupSummary, error) {
+	query := opts.Query
+	if query == "" {
+		query = defaultDedupQuery
+	}
+	query = Selection{Query: query}.withQuery(s.protection.exclusion()).Query
+	maxMessages := opts.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = DefaultAnalyticsMaxMessages
+	}
+	sampleSize := opts.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = DefaultPreviewSampleSize
+	}
+
+	if err := s.CheckDedupAccess(opts); err != nil {
+		return nil, err
+	}
+	guard, err := s.guard(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	summary := &DedupSummary{Query: query, DryRun: opts.DryRun, Samples: []*DuplicateGroup{}}
+	runID := opts.RunID
+	if !opts.DryRun && runID == "" {
+		if runID, err = ids.New(); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.DryRun && s.journal != nil {
+		summary.RunID = runID
+	}
+	if opts.Progress != nil {
+		ctx = gmail.WithProgress(ctx, opts.Progress)
+	}
+
+	start := time.Now()
+	log := logger.L().With(zap.String("user_id", userID), zap.String("query", query), zap.String("run_id", summary.RunID))
+	log.Info("Starting duplicate message search",
+		zap.Int64("max_messages", maxMessages),
+		zap.Bool("dry_run", opts.DryRun),
+	)
+
+	copies := make(map[string][]*gmail.MessageMetadata)
+	failed, err := s.gmail.ScanMessageMetadata(ctx, userID, query, maxMessages, func(m *gmail.MessageMetadata) {
+		summary.Scanned++
+		key := dedupKey(m)
+		copies[key] = append(copies[key], m)
+	})
+	summary.Failed = failed
+	if err != nil {
+		return nil, err
+	}
+	summary.Truncated = int64(summary.Scanned+summary.Failed) >= maxMessages
+
+	var groups []*DuplicateGroup
+	var duplicates []*gmail.MessageMetadata
+	for key, msgs := range copies {
+		if len(msgs) < 2 {
+			continue
+		}
+		sort.Slice(msgs, func(i, j int) bool {
+			if !msgs[i].Date.Equal(msgs[j].Date) {
+				return msgs[i].Date.Before(msgs[j].Date)
+			}
+			return msgs[i].ID < msgs[j].ID
+		})
+		if opts.Keep == KeepNewest {
+			msgs[0], msgs[len(msgs)-1] = msgs[len(msgs)-1], msgs[0]
+		}
+		g := &DuplicateGroup{Key: key, From: msgs[0].From, Subject: msgs[0].Subject, Kept: msgs[0].ID}
+		for _, m := range msgs[1:] {
+			g.Duplicates = append(g.Duplicates, m.ID)
+		}
+		groups = append(groups, g)
+		duplicates = append(duplicates, msgs[1:]...)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Duplicates) != len(groups[j].Duplicates) {
+			return len(groups[i].Duplicates) > len(groups[j].Duplicates)
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	summary.Groups = len(groups)
+	summary.Duplicates = len(duplicates)
+	duplicates = summary.skipProtected(guard, duplicates)
+	if len(groups) > sampleSize {
+		summary.Samples = groups[:sampleSize]
+	} else if len(groups) > 0 {
+		summary.Samples = groups
+	}
+
+	if !opts.DryRun && len(duplicates) > 0 {
+		messageIDs := make([]string, len(duplicates))
+		for i, m := range duplicates {
+			messageIDs[i] = m.ID
+		}
+		summary.Trashed, err = s.gmail.BatchTrashMessages(ctx, userID, messageIDs)
+		if err != nil {
+			summary.Error = err.Error()
+		}
+		// Messages are trashed in order, so the first Trashed of them moved.
+		s.journalTrashedMessages(summary.RunID, duplicates[:summary.Trashed])
+	}
+
+	log.Info("Completed duplicate message search",
+		zap.Int("scanned_count", summary.Scanned),
+		zap.Int("group_count", summary.Groups),
+		zap.Int("duplicate_count", summary.Duplicates),
+		zap.Int("skipped_count", summary.Skipped),
+		zap.Int("trashed_count", summary.Trashed),
+		zap.Duration("duration", time.Since(start)),
+		zap.Error(err),
+	)
+	return summary, err
+}
+
+// skipProtected returns the duplicates guard does not protect, counting the
+// others in the summary.
+func (d *DedupSummary) skipProtected(guard *messageGuard, duplicates []*gmail.MessageMetadata) []*gmail.MessageMetadata {
+	kept := duplicates[:0]
+	for _, m := range duplicates {
+		reason := guard.reason(&gmail.ThreadMessage{ID: m.ID, LabelIDs: m.LabelIDs, From: m.From})
+		if reason == "" {
+			kept = append(kept, m)
+			continue
+		}
+		if d.SkippedReasons == nil {
+			d.SkippedReasons = make(map[string]int)
+		}
+		d.SkippedReasons[reason]++
+		d.Skipped++
+	}
+	return kept
+}
@@ -0,0 +1,436 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+var (
+	// ErrNewsletterNotFound is returned when no mail matches a newsletter ID.
+	ErrNewsletterNotFound = errors.New("newsletter not found")
+	// ErrNoUnsubscribeMethod is returned when a newsletter offers no usable
+	// way to unsubscribe with the requested method.
+	ErrNoUnsubscribeMethod = errors.New("newsletter offers no supported unsubscribe method")
+	// ErrUnsubscribeFailed is returned when the list rejected the unsubscribe
+	// request or could not be reached.
+	ErrUnsubscribeFailed = errors.New("unsubscribe request failed")
+)
+
+// UnsubscribeMethod is how a newsletter is unsubscribed from.
+type UnsubscribeMethod string
+
+const (
+	// UnsubscribeOneClick POSTs to the list's HTTPS unsubscribe URL as
+	// described in RFC 8058.
+	UnsubscribeOneClick UnsubscribeMethod = "one_click"
+	// UnsubscribeMailto sends an email to the list's unsubscribe address.
+	UnsubscribeMailto UnsubscribeMethod = "mailto"
+)
+
+// Newsletter groups the mail of one mailing list, identified by its List-Id
+// header or, without one, by sender.
+type Newsletter struct {
+	// ID is the list ID, or the sender address for lists without one.
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Sender    string    `json:"sender"`
+	Count     int       `json:"count"`
+	SizeBytes int64     `json:"size_bytes"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Query is the Gmail search query selecting the newsletter's mail.
+	Query string `json:"query"`
+	// Methods are the unsubscribe methods offered by the most recent message.
+	Methods []UnsubscribeMethod `json:"methods"`
+}
+
+// NewsletterOptions selects the messages scanned for newsletters.
+type NewsletterOptions struct {
+	// Query is a Gmail search query; by default recent mail is scanned.
+	Query string
+	// MaxMessages caps the number of messages scanned.
+	MaxMessages int64
+}
+
+// NewsletterReport lists the newsletters found in a mailbox, largest first.
+type NewsletterReport struct {
+	Scanned     int           `json:"scanned"`
+	Failed      int           `json:"failed"`
+	Truncated   bool          `json:"truncated"`
+	Newsletters []*Newsletter `json:"newsletters"`
+}
+
+// UnsubscribeOptions describes an unsubscribe request.
+type UnsubscribeOptions struct {
+	// ID is the Newsletter.ID to unsubscribe from.
+	ID string
+	// Method forces an unsubscribe method. By default one-click is preferred
+	// over mailto.
+	Method UnsubscribeMethod
+	// Clean, if set, cleans the newsletter's existing threads once
+	// unsubscribed. Its Categories, Query, Retention and Rules are replaced
+	// by the newsletter's query.
+	Clean *CleanOptions
+}
+
+// UnsubscribeResult reports how a newsletter was unsubscribed from.
+type UnsubscribeResult struct {
+	ID     string            `json:"id"`
+	Method UnsubscribeMethod `json:"method"`
+	// Target is the host POSTed to or the address mailed.
+	Target string `json:"target"`
+	// Cleanup is the summary of cleaning the newsletter's threads, if requested.
+	Cleanup *CleanSummary `json:"cleanup,omitempty"`
+}
+
+// DefaultNewsletterMaxMessages is used when NewsletterOptions leaves
+// MaxMessages unset.
+const DefaultNewsletterMaxMessages = 2000
+
+// defaultNewsletterQuery limits newsletter detection to mail that is still
+// arriving, so that lists the user has already left are not reported.
+const defaultNewsletterQuery = "newer_than:6m"
+
+// validNewsletterID keeps newsletter IDs from altering the search query they
+// are embedded in.
+var validNewsletterID = regexp.MustCompile(`^[A-Za-z0-9._%+=@-]{1,255}$`)
+
+type NewsletterService struct {
+	gmail   *gmail.Service
+	cleaner *CleanerService
+	client  *http.Client
+}
+
+// NewNewsletterService creates a NewsletterService. cleaner cleans the threads
+// of newsletters unsubscribed from; it may be nil if that is never requested.
+func NewNewsletterService(g *gmail.Service, cleaner *CleanerService) *NewsletterService {
+	return &NewsletterService{gmail: g, cleaner: cleaner, client: unsubscribeClient}
+}
+
+// Newsletters scans the messages selected by opts and groups those carrying
+// List-Id or List-Unsubscribe headers by list.
+func (s *NewsletterService) Newsletters(ctx context.Context, userID string, opts *NewsletterOptions) (*NewsletterReport, error) {
+	query := opts.Query
+	if query == "" {
+		query = defaultNewsletterQuery
+	}
+	maxMessages := opts.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = DefaultNewsletterMaxMessages
+	}
+
+	report := &NewsletterReport{}
+	lists := make(map[string]*Newsletter)
+	latest := make(map[string]*gmail.MessageMetadata)
+	failed, err := s.gmail.ScanMessageMetadata(ctx, userID, query, maxMessages, func(m *gmail.MessageMetadata) {
+		report.Scanned++
+		if m.ListID == "" && m.ListUnsubscribe == "" {
+			return
+		}
+		n := newsletterFor(lists, m)
+		if n == nil {
+			return
+		}
+		n.Count++
+		n.SizeBytes += m.SizeEstimate
+		if m.Date.After(n.LastSeen) {
+			n.LastSeen = m.Date
+			latest[n.ID] = m
+		}
+	})
+	report.Failed = failed
+	if err != nil {
+		return nil, err
+	}
+	report.Truncated = int64(report.Scanned+report.Failed) >= maxMessages
+
+	for id, n := range lists {
+		m := latest[id]
+		n.Sender, _ = parseSender(m.From)
+		n.Methods = unsubscribeMethods(m)
+		report.Newsletters = append(report.Newsletters, n)
+	}
+	sort.Slice(report.Newsletters, func(i, j int) bool {
+		a, b := report.Newsletters[i], report.Newsletters[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.ID < b.ID
+	})
+
+	logger.L().Info("Detected newsletters",
+		zap.String("user_id", userID),
+		zap.String("query", query),
+		zap.Int("scanned_count", report.Scanned),
+		zap.Int("newsletter_count", len(report.Newsletters)),
+	)
+	return report, nil
+}
+
+// newsletterFor returns the entry of lists m belongs to, adding it if needed.
+// It returns nil for messages that cannot be attributed to a list.
+func newsletterFor(lists map[string]*Newsletter, m *gmail.MessageMetadata) *Newsletter {
+	id, name := parseListID(m.ListID)
+	if id == "" {
+		id, _ = parseSender(m.From)
+	}
+	if !validNewsletterID.MatchString(id) {
+		return nil
+	}
+	n := lists[id]
+	if n == nil {
+		n = &Newsletter{ID: id, Name: name, Query: newsletterQuery(id)}
+		lists[id] = n
+	}
+	return n
+}
+
+// parseListID splits a List-Id header such as `Weekly News <news.example.com>`
+// into the list ID and its description.
+func parseListID(h string) (id, name string) {
+	h = strings.TrimSpace(h)
+	start, end := strings.LastIndex(h, "<"), strings.LastIndex(h, ">")
+	if start < 0 || end < start {
+		return strings.ToLower(h), ""
+	}
+	return strings.ToLower(strings.TrimSpace(h[start+1 : end])), strings.Trim(strings.TrimSpace(h[:start]), `"`)
+}
+
+// newsletterQuery returns the Gmail search query selecting a newsletter's mail.
+func newsletterQuery(id string) string {
+	if strings.Contains(id, "@") {
+		return "from:" + id
+	}
+	return "list:" + id
+}
+
+// unsubscribeTargets returns the HTTPS and mailto URLs of a List-Unsubscribe
+// header, which lists them in angle brackets separated by commas.
+func unsubscribeTargets(h string) (https *url.URL, mailto *url.URL) {
+	for _, part := range strings.Split(h, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "<") || !strings.HasSuffix(part, ">") {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(part[1 : len(part)-1]))
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "https":
+			if https == nil && u.Host != "" && u.User == nil {
+				https = u
+			}
+		case "mailto":
+			if mailto == nil {
+				mailto = u
+			}
+		}
+	}
+	return https, mailto
+}
+
+// unsubscribeMethods returns the methods m supports, preferred first.
+// One-click requires an HTTPS URL and the RFC 8058 List-Unsubscribe-Post header.
+func unsubscribeMethods(m *gmail.MessageMetadata) []UnsubscribeMethod {
+	methods := []UnsubscribeMethod{}
+	https, mailto := unsubscribeTargets(m.ListUnsubscribe)
+	if https != nil && strings.EqualFold(strings.TrimSpace(m.ListUnsubscribePost), "List-Unsubscribe=One-Click") {
+		methods = append(methods, UnsubscribeOneClick)
+	}
+	if mailto != nil {
+		methods = append(methods, UnsubscribeMailto)
+	}
+	return methods
+}
+
+// Unsubscribe unsubscribes from the newsletter opts.ID using the headers of
+// its most recent message, then optionally cleans its existing threads.
+// Unsubscribe URLs come from the mail itself; one-click requests are only
+// sent over HTTPS to public addresses and redirects are not followed.
+func (s *NewsletterService) Unsubscribe(ctx context.Context, userID string, opts *UnsubscribeOptions) (*UnsubscribeResult, error) {
+	if !validNewsletterID.MatchString(opts.ID) {
+		return nil, ErrNewsletterNotFound
+	}
+	query := newsletterQuery(opts.ID)
+
+	var latest *gmail.MessageMetadata
+	if _, err := s.gmail.ScanMessageMetadata(ctx, userID, query, 1, func(m *gmail.MessageMetadata) {
+		latest = m
+	}); err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, ErrNewsletterNotFound
+	}
+
+	method := opts.Method
+	available := unsubscribeMethods(latest)
+	if method == "" && len(available) > 0 {
+		method = available[0]
+	}
+	supported := false
+	for _, m := range available {
+		supported = supported || m == method
+	}
+	if !supported {
+		return nil, ErrNoUnsubscribeMethod
+	}
+
+	// Check access up front, so that a cleanup the token cannot perform does
+	// not fail after the unsubscribe was sent.
+	if method == UnsubscribeMailto {
+		if err := s.gmail.Require(gmail.AccessModify); err != nil {
+			return nil, err
+		}
+	}
+	var clean *CleanOptions
+	if opts.Clean != nil && s.cleaner != nil {
+		c := *opts.Clean
+		c.Categories, c.Retention, c.Rules = nil, nil, nil
+		c.Query = query
+		if err := s.cleaner.CheckAccess(&c); err != nil {
+			return nil, err
+		}
+		clean = &c
+	}
+
+	log := logger.L().With(zap.String("user_id", userID), zap.String("newsletter", opts.ID), zap.String("method", string(method)))
+	result := &UnsubscribeResult{ID: opts.ID, Method: method}
+	https, mailto := unsubscribeTargets(latest.ListUnsubscribe)
+	var err error
+	switch method {
+	case UnsubscribeOneClick:
+		result.Target = https.Hostname()
+		err = s.oneClick(ctx, https)
+	case UnsubscribeMailto:
+		result.Target, err = s.mailto(ctx, userID, mailto)
+	}
+	if err != nil {
+		log.Warn("Failed to unsubscribe from newsletter", zap.Error(err))
+		return nil, err
+	}
+	log.Info("Unsubscribed from newsletter", zap.String("target", result.Target))
+
+	if clean != nil {
+		result.Cleanup, err = s.cleaner.Clean(ctx, userID, clean)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// oneClick sends the RFC 8058 one-click unsubscribe POST to u.
+func (s *NewsletterService) oneClick(ctx context.Context, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsubscribeFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsubscribeFailed, err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%w: %s responded %s", ErrUnsubscribeFailed, u.Hostname(), res.Status)
+	}
+	return nil
+}
+
+// mailto sends the unsubscribe email described by a mailto URL (RFC 6068)
+// and returns the address it was sent to.
+func (s *NewsletterService) mailto(ctx context.Context, userID string, u *url.URL) (string, error) {
+	to := u.Opaque
+	if to == "" {
+		to = u.Path
+	}
+	to, err := url.PathUnescape(to)
+	if err != nil {
+		return "", ErrNoUnsubscribeMethod
+	}
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return "", ErrNoUnsubscribeMethod
+	}
+	params := u.Query()
+	subject := params.Get("subject")
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+	body := params.Get("body")
+	if body == "" {
+		body = "unsubscribe"
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		return "", ErrNoUnsubscribeMethod
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "To: %s\r\n", addr.String())
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	raw.WriteString("MIME-Version: 1.0\r\n")
+	raw.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	raw.WriteString(body)
+	raw.WriteString("\r\n")
+
+	if err := s.gmail.SendMessage(ctx, userID, raw.Bytes()); err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
+
+// unsubscribeClient sends one-click unsubscribe requests. The URLs come from
+// incoming mail, so it only connects to public addresses, ignores proxy
+// settings and does not follow redirects.
+var unsubscribeClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
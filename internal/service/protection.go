@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"mailcleanerpro/internal/rules"
+	"mailcleanerpro/pkg/gmail"
+)
+
+// Protection describes threads that cleanup must never touch. A thread is
+// protected if any of its messages carries one of Labels or was sent by one of
+// Senders.
+type Protection struct {
+	// Labels are Gmail label IDs such as STARRED or IMPORTANT, or the names of
+	// user labels.
+	Labels []string
+	// Senders are email addresses (alice@example.com) or domains (example.com
+	// or @example.com).
+	Senders []string
+}
+
+// DefaultProtection protects starred and important threads.
+func DefaultProtection() *Protection {
+	return &Protection{Labels: []string{"STARRED", "IMPORTANT"}}
+}
+
+// protectionRule is a single protection criterion as a Gmail search term,
+// along with the reason reported for threads it skips.
+type protectionRule struct {
+	Reason string
+	Term   string
+}
+
+// rules returns the search terms matching protected threads.
+func (p *Protection) rules() []protectionRule {
+	var rules []protectionRule
+	for _, label := range p.Labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		switch strings.ToUpper(label) {
+		case "STARRED":
+			rules = append(rules, protectionRule{Reason: "starred", Term: "is:starred"})
+		case "IMPORTANT":
+			rules = append(rules, protectionRule{Reason: "important", Term: "is:important"})
+		default:
+			rules = append(rules, protectionRule{Reason: "label:" + label, Term: "label:" + labelSearchName(label)})
+		}
+	}
+
+	var senders []string
+	for _, sender := range p.Senders {
+		sender = strings.TrimPrefix(strings.TrimSpace(sender), "@")
+		if sender != "" {
+			senders = append(senders, sender)
+		}
+	}
+	if len(senders) > 0 {
+		rules = append(rules, protectionRule{
+			Reason: "allowlisted_sender",
+			Term:   "from:{" + strings.Join(senders, " ") + "}",
+		})
+	}
+	return rules
+}
+
+// exclusion returns a search query excluding every protected thread, or "" if
+// nothing is protected.
+func (p *Protection) exclusion() string {
+	rules := p.rules()
+	terms := make([]string, 0, len(rules))
+	for _, r := range rules {
+		terms = append(terms, "-"+r.Term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// messageGuard checks the messages of expanded threads against a Protection.
+// Search queries select threads, so a thread with both protected and
+// unprotected messages can still be listed; the guard catches those.
+type messageGuard struct {
+	// labels maps protected label IDs to the reason reported for them.
+	labels  map[string]string
+	senders []string
+}
+
+// guard returns a messageGuard for the service's protection. Label names are
+// resolved to label IDs; labels that do not exist protect nothing.
+func (s *CleanerService) guard(ctx context.Context, userID string) (*messageGuard, error) {
+	g := &messageGuard{labels: make(map[string]string)}
+	for _, label := range s.protection.Labels {
+		label = strings.TrimSpace(label)
+		switch strings.ToUpper(label) {
+		case "":
+		case "STARRED":
+			g.labels["STARRED"] = "starred"
+		case "IMPORTANT":
+			g.labels["IMPORTANT"] = "important"
+		default:
+			ids, err := s.gmail.ResolveLabelIDs(ctx, userID, []string{label})
+			if errors.Is(err, gmail.ErrUnknownLabel) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			g.labels[ids[0]] = "label:" + label
+		}
+	}
+	for _, sender := range s.protection.Senders {
+		if sender = strings.TrimSpace(sender); sender != "" {
+			g.senders = append(g.senders, sender)
+		}
+	}
+	return g, nil
+}
+
+// reason returns why m is protected, or "" if it is not.
+func (g *messageGuard) reason(m *gmail.ThreadMessage) string {
+	for _, l := range m.LabelIDs {
+		if reason, ok := g.labels[l]; ok {
+			return reason
+		}
+	}
+	for _, sender := range g.senders {
+		if rules.MatchSender(m.From, sender) {
+			return "allowlisted_sender"
+		}
+	}
+	return ""
+}
+
+// skip marks every pending thread of batch with a protected message as
+// skipped, so that none of its messages is touched.
+func (g *messageGuard) skip(batch *gmail.BatchResult) {
+	for _, tr := range batch.Pending() {
+		for _, m := range tr.Messages {
+			if reason := g.reason(m); reason != "" {
+				tr.Skipped = reason
+				break
+			}
+		}
+	}
+}
+
+// labelSearchName converts a label name to the form Gmail search expects,
+// where spaces and nesting slashes become hyphens.
+func labelSearchName(name string) string {
+	return strings.NewReplacer(" ", "-", "/", "-").Replace(strings.ToLower(name))
+}
+
+// withQuery returns sel narrowed down by an extra search query.
+func (sel Selection) withQuery(query string) Selection {
+	switch {
+	case query == "":
+	case sel.Query == "":
+		sel.Query = query
+	default:
+		sel.Query = "(" + sel.Query + ") " + query
+	}
+	return sel
+}
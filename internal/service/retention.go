@@ -0,0 +1,74 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RetentionRule keeps threads under a label for a limited time. Threads older
+// than MaxAgeDays, and at least MinSizeBytes large if set, are cleaned.
+type RetentionRule struct {
+	// Label is a Gmail label ID, e.g. CATEGORY_PROMOTIONS or a user label ID.
+	Label        string `json:"label"`
+	MaxAgeDays   int    `json:"max_age_days"`
+	MinSizeBytes int64  `json:"min_size_bytes,omitempty"`
+}
+
+// Selection compiles the rule into the Gmail selection it cleans.
+func (r RetentionRule) Selection() Selection {
+	query := fmt.Sprintf("older_than:%dd", r.MaxAgeDays)
+	if r.MinSizeBytes > 0 {
+		query += fmt.Sprintf(" larger:%d", r.MinSizeBytes)
+	}
+	return Selection{Name: r.Label, LabelID: r.Label, Query: query}
+}
+
+// RetentionPolicy is a saved set of retention rules, such as "Promotions for
+// 30 days, Social for 90 days, Updates for a year".
+type RetentionPolicy struct {
+	ID    string          `json:"id"`
+	Owner string          `json:"owner"`
+	Name  string          `json:"name"`
+	Rules []RetentionRule `json:"rules"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	// LastJobID is the background job of the most recent run.
+	LastJobID string `json:"last_job_id,omitempty"`
+}
+
+// Validate reports whether the policy's rules can be run.
+func (p *RetentionPolicy) Validate() error {
+	if len(p.Rules) == 0 {
+		return errors.New("retention policy has no rules")
+	}
+	seen := make(map[string]bool, len(p.Rules))
+	for _, r := range p.Rules {
+		if r.Label == "" {
+			return errors.New("retention rule is missing a label")
+		}
+		if seen[r.Label] {
+			return fmt.Errorf("label %s has more than one retention rule", r.Label)
+		}
+		seen[r.Label] = true
+		if r.MaxAgeDays <= 0 {
+			return fmt.Errorf("retention rule for %s needs a positive max_age_days", r.Label)
+		}
+		if r.MinSizeBytes < 0 {
+			return fmt.Errorf("retention rule for %s has a negative min_size_bytes", r.Label)
+		}
+	}
+	return nil
+}
+
+// Selections compiles the policy into the selections a cleanup run processes,
+// one per rule.
+func (p *RetentionPolicy) Selections() []Selection {
+	sels := make([]Selection, 0, len(p.Rules))
+	for _, r := range p.Rules {
+		sels = append(sels, r.Selection())
+	}
+	return sels
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/internal/rules"
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// applyRules fetches the metadata of each thread in ids, evaluates opts.Rules
+// against it and applies the action of the first matching rule. Outcomes are
+// recorded per rule in summary.Rules and for the whole selection in res. In a
+// dry run nothing is modified and the matched threads are described in
+// summary.Preview, keyed by rule name.
+func (s *CleanerService) applyRules(ctx context.Context, userID string, sel Selection, ids []string, opts *CleanOptions, summary *CleanSummary, res *SelectionResult, run *cleanRun) error {
+	sampleSize := opts.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = DefaultPreviewSampleSize
+	}
+	if summary.Rules == nil {
+		summary.Rules = make(map[string]*SelectionResult)
+	}
+	ruleList := opts.Rules.Rules()
+	for _, rule := range ruleList {
+		if summary.Rules[rule.Name] == nil {
+			summary.Rules[rule.Name] = &SelectionResult{Action: rule.Action}
+		}
+		if opts.DryRun && summary.Preview[rule.Name] == nil {
+			summary.Preview[rule.Name] = &SelectionPreview{
+				Permanent: rule.Action == rules.ActionDelete,
+				Samples:   make([]*gmail.ThreadMetadata, 0, sampleSize),
+			}
+		}
+	}
+	defer func() { res.Failed = len(res.FailedThreads) }()
+
+	var firstErr error
+	matched := make(map[string][]string)
+	now := time.Now()
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		meta, err := s.gmail.GetThreadMetadata(ctx, userID, id)
+		if err != nil {
+			res.FailedThreads = append(res.FailedThreads, &FailedThread{
+				ThreadID: id,
+				Reason:   err.Error(),
+				Code:     gmail.Code(err),
+			})
+			if opts.errorPolicy() == ErrorPolicyStop {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		gmail.ReportProgress(ctx, gmail.ProgressEvent{
+			Type:      gmail.EventBatchProgress,
+			Operation: "evaluate",
+			Done:      i + 1,
+			Total:     len(ids),
+		})
+
+		rule, ok := opts.Rules.Evaluate(meta, now)
+		if !ok {
+			continue
+		}
+		matched[rule.Name] = append(matched[rule.Name], id)
+		if opts.DryRun {
+			p := summary.Preview[rule.Name]
+			p.Matched++
+			if len(p.Samples) < sampleSize {
+				p.Samples = append(p.Samples, meta)
+			}
+		}
+	}
+
+	for _, rule := range ruleList {
+		threadIDs := matched[rule.Name]
+		rr := summary.Rules[rule.Name]
+		rr.Matched += len(threadIDs)
+		if opts.DryRun || len(threadIDs) == 0 {
+			continue
+		}
+
+		batch, err := s.applyOperation(ctx, userID, rule.Operation, threadIDs, run)
+		s.journalBatch(ctx, userID, summary.RunID, rule.Operation, batch)
+		rr.addSkipped(batch)
+		summary.TotalSkipped += res.addSkipped(batch)
+		succeeded := len(batch.Succeeded())
+		rr.Succeeded += succeeded
+		res.Succeeded += succeeded
+		if rule.Destructive() {
+			summary.PerCategoryDeleted[sel.Name] += succeeded
+			summary.TotalDeleted += succeeded
+		} else {
+			summary.TotalModified += succeeded
+		}
+		for _, tr := range batch.Failed() {
+			failed := &FailedThread{
+				ThreadID: tr.ThreadID,
+				Reason:   tr.Err.Error(),
+				Code:     gmail.Code(tr.Err),
+			}
+			rr.FailedThreads = append(rr.FailedThreads, failed)
+			res.FailedThreads = append(res.FailedThreads, failed)
+		}
+		rr.Failed = len(rr.FailedThreads)
+
+		logger.L().Info("Applied cleanup rule",
+			zap.String("category", sel.Name),
+			zap.String("rule", rule.Name),
+			zap.String("action", string(rule.Action)),
+			zap.Int("matched_count", len(threadIDs)),
+			zap.Int("succeeded_count", succeeded),
+			zap.Error(err),
+		)
+		if err != nil {
+			if opts.errorPolicy() == ErrorPolicyStop {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// applyOperation performs op on threadIDs. Label names in op are resolved to
+// label IDs. Threads are expanded into their messages first, and threads with
+// a protected message are skipped. Before threads are trashed or deleted,
+// whatever run is asked to preserve is saved; threads that could not be saved
+// are reported as failed instead of being removed.
+func (s *CleanerService) applyOperation(ctx context.Context, userID string, op rules.Operation, threadIDs []string, run *cleanRun) (*gmail.BatchResult, error) {
+	if len(threadIDs) == 0 {
+		return &gmail.BatchResult{}, nil
+	}
+	add, remove, err := s.labelChanges(ctx, userID, op)
+	if err != nil {
+		return &gmail.BatchResult{}, err
+	}
+	guard, err := s.guard(ctx, userID)
+	if err != nil {
+		return &gmail.BatchResult{}, err
+	}
+
+	batch := s.gmail.ExpandThreads(ctx, userID, threadIDs)
+	guard.skip(batch)
+	if op.Destructive() {
+		run.preserve(ctx, s.gmail, userID, op, batch.Pending())
+	}
+	switch op.Action {
+	case rules.ActionDelete:
+		err = s.gmail.DeleteExpanded(ctx, userID, batch)
+	case rules.ActionTrash:
+		err = s.gmail.TrashExpanded(ctx, userID, batch)
+	default:
+		err = s.gmail.ModifyExpanded(ctx, userID, batch, add, remove)
+	}
+	return batch, err
+}
+
+// labelChanges returns the label IDs op adds and removes. Trashing adds TRASH
+// and removes INBOX; permanent deletion changes no labels.
+func (s *CleanerService) labelChanges(ctx context.Context, userID string, op rules.Operation) (add, remove []string, err error) {
+	switch op.Action {
+	case rules.ActionDelete:
+		return nil, nil, nil
+	case rules.ActionTrash:
+		return []string{"TRASH"}, []string{"INBOX"}, nil
+	}
+	add, remove = op.LabelChanges()
+	if add, err = s.gmail.ResolveLabelIDs(ctx, userID, add); err != nil {
+		return nil, nil, err
+	}
+	if remove, err = s.gmail.ResolveLabelIDs(ctx, userID, remove); err != nil {
+		return nil, nil, err
+	}
+	return add, remove, nil
+}
+
+// CheckAccess returns a *gmail.AccessError if the token's scopes do not allow
+// the run opts describes: a dry run only reads, permanent deletion needs full
+// access and every other change modify access. It is checked before a run
+// starts, so that a run is not rejected by Gmail halfway through.
+func (s *CleanerService) CheckAccess(opts *CleanOptions) error {
+	if opts.DryRun {
+		return s.gmail.Require(gmail.AccessReadOnly)
+	}
+	var ops []rules.Operation
+	if opts.Rules != nil {
+		for _, r := range opts.Rules.Rules() {
+			ops = append(ops, r.Operation)
+		}
+	} else {
+		for _, sel := range opts.Selections() {
+			ops = append(ops, opts.operation(sel))
+		}
+	}
+	required := gmail.AccessModify
+	for _, op := range ops {
+		if op.Action == rules.ActionDelete {
+			required = gmail.AccessFull
+		}
+	}
+	return s.gmail.Require(required)
+}
+
+// checkLabels makes sure every label used by the operations of opts exists,
+// so that a run fails before touching anything rather than halfway through.
+func (s *CleanerService) checkLabels(ctx context.Context, userID string, opts *CleanOptions) error {
+	var ops []rules.Operation
+	if opts.Action != nil {
+		ops = append(ops, *opts.Action)
+	}
+	if opts.Rules != nil {
+		for _, r := range opts.Rules.Rules() {
+			ops = append(ops, r.Operation)
+		}
+	}
+	for _, op := range ops {
+		add, remove := op.LabelChanges()
+		if _, err := s.gmail.ResolveLabelIDs(ctx, userID, append(add, remove...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// narrowing returns a search query excluding threads op would leave unchanged,
+// or "" if there is none.
+func narrowing(op rules.Operation) string {
+	switch op.Action {
+	case rules.ActionArchive, rules.ActionMove:
+		return "in:inbox"
+	case rules.ActionMarkRead:
+		return "is:unread"
+	}
+	return ""
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/internal/journal"
+	"mailcleanerpro/internal/rules"
+	"mailcleanerpro/pkg/gmail"
+	"mailcleanerpro/pkg/logger"
+)
+
+// ErrJournalDisabled is returned by Undo when the service keeps no journal.
+var ErrJournalDisabled = errors.New("undo journal is not enabled")
+
+// UndoSummary reports the outcome of undoing a run.
+type UndoSummary struct {
+	RunID string `json:"run_id"`
+	// Restored counts the messages restored, or whole threads for journals
+	// that recorded threads.
+	Restored int `json:"restored"`
+	Failed   int `json:"failed"`
+	// NotRestorable counts permanently deleted threads, which cannot be recovered.
+	NotRestorable int             `json:"not_restorable"`
+	FailedThreads []*FailedThread `json:"failed_threads,omitempty"`
+}
+
+// journalBatch records the messages op changed in the journal of runID, along
+// with the labels it actually added to and removed from each, so that undo
+// restores every message exactly as it was. Permanently deleted threads are
+// recorded whole, as they cannot be restored. Journal failures are logged
+// rather than failing the run, as the changes have already been made.
+func (s *CleanerService) journalBatch(ctx context.Context, userID, runID string, op rules.Operation, batch *gmail.BatchResult) {
+	if s.journal == nil || runID == "" || batch == nil {
+		return
+	}
+	log := logger.L().With(zap.String("run_id", runID), zap.String("action", string(op.Action)))
+
+	add, remove, err := s.labelChanges(ctx, userID, op)
+	if err != nil {
+		log.Error("Failed to journal cleanup changes", zap.Error(err))
+		return
+	}
+	owner := s.gmail.EmailAddress()
+
+	now := time.Now().UTC()
+	var entries []journal.Entry
+	for _, tr := range batch.Results {
+		// A failed thread may still have had some of its messages changed.
+		messages := tr.Messages
+		if tr.Err != nil {
+			messages = messages[:tr.Applied]
+		}
+		if tr.Skipped != "" || len(messages) == 0 {
+			continue
+		}
+		base := journal.Entry{
+			RunID:    runID,
+			Owner:    owner,
+			Time:     now,
+			Action:   string(op.Action),
+			ThreadID: tr.ThreadID,
+		}
+		if op.Action == rules.ActionDelete {
+			entries = append(entries, base)
+			continue
+		}
+		for _, m := range messages {
+			base.MessageID = m.ID
+			if e, ok := messageEntry(base, m.LabelIDs, add, remove); ok {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	if err := s.journal.Append(runID, entries); err != nil {
+		log.Error("Failed to journal cleanup changes", zap.Int("entry_count", len(entries)), zap.Error(err))
+	}
+}
+
+// messageEntry completes base, the entry of a message that carried labels,
+// with the labels of add it lacked and the labels of remove it had. It reports
+// false if the change left the message as it was.
+func messageEntry(base journal.Entry, labels, add, remove []string) (journal.Entry, bool) {
+	had := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		had[l] = true
+	}
+	e := base
+	for _, l := range add {
+		if !had[l] {
+			e.AddedLabels = append(e.AddedLabels, l)
+		}
+	}
+	for _, l := range remove {
+		if had[l] {
+			e.RemovedLabels = append(e.RemovedLabels, l)
+		}
+	}
+	return e, len(e.AddedLabels) > 0 || len(e.RemovedLabels) > 0
+}
+
+// journalTrashedMessages records the messages moved to trash by a
+// message-level run in the journal of runID. Journal failures are logged
+// rather than failing the run, as the changes have already been made.
+func (s *CleanerService) journalTrashedMessages(runID string, msgs []*gmail.MessageMetadata) {
+	if s.journal == nil || runID == "" || len(msgs) == 0 {
+		return
+	}
+	owner := s.gmail.EmailAddress()
+
+	now := time.Now().UTC()
+	entries := make([]journal.Entry, 0, len(msgs))
+	for _, m := range msgs {
+		e, ok := messageEntry(journal.Entry{
+			RunID:     runID,
+			Owner:     owner,
+			Time:      now,
+			Action:    string(rules.ActionTrash),
+			ThreadID:  m.ThreadID,
+			MessageID: m.ID,
+		}, m.LabelIDs, []string{"TRASH"}, []string{"INBOX"})
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+
+	if err := s.journal.Append(runID, entries); err != nil {
+		logger.L().Error("Failed to journal trashed messages",
+			zap.String("run_id", runID),
+			zap.Int("message_count", len(entries)),
+			zap.Error(err),
+		)
+	}
+}
+
+// Undo reverts the changes journaled for runID: each message journaled gets
+// back the labels the run removed from it and loses those the run added, such
+// as TRASH, leaving its other messages and later mail alone. Thread-level
+// entries of older journals are reverted on the whole thread. Entries already
+// reverted by an earlier undo are skipped, and permanently deleted threads are
+// counted as not restorable. Journals of other accounts are reported as
+// journal.ErrNotFound.
+func (s *CleanerService) Undo(ctx context.Context, userID, runID string) (*UndoSummary, error) {
+	if s.journal == nil {
+		return nil, ErrJournalDisabled
+	}
+	if err := s.gmail.Require(gmail.AccessModify); err != nil {
+		return nil, err
+	}
+	entries, err := s.journal.Read(runID)
+	if err != nil {
+		return nil, err
+	}
+	owner := s.gmail.EmailAddress()
+	for _, e := range entries {
+		if e.Owner != owner {
+			return nil, journal.ErrNotFound
+		}
+	}
+
+	log := logger.L().With(zap.String("run_id", runID), zap.String("user_id", userID))
+	pending := journal.Pending(entries)
+	log.Info("Starting undo of cleanup run", zap.Int("thread_count", len(pending)))
+
+	summary := &UndoSummary{RunID: runID}
+	var undone []journal.Entry
+	defer func() {
+		if err := s.journal.Append(runID, undone); err != nil {
+			log.Error("Failed to journal undo", zap.Error(err))
+		}
+	}()
+
+	var messages []journal.Entry
+	for _, e := range pending {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		if e.Action == string(rules.ActionDelete) {
+			summary.NotRestorable++
+			continue
+		}
+		if e.MessageID != "" {
+			messages = append(messages, e)
+			continue
+		}
+		if err := s.revert(ctx, userID, e); err != nil {
+			log.Warn("Failed to restore thread", zap.String("thread_id", e.ThreadID), zap.Error(err))
+			summary.FailedThreads = append(summary.FailedThreads, &FailedThread{
+				ThreadID: e.ThreadID,
+				Reason:   err.Error(),
+				Code:     gmail.Code(err),
+			})
+			continue
+		}
+		summary.Restored++
+		undone = append(undone, journal.Entry{
+			RunID:    runID,
+			Owner:    owner,
+			Time:     time.Now().UTC(),
+			Action:   journal.ActionUndo,
+			ThreadID: e.ThreadID,
+		})
+	}
+	restored, failed := s.revertMessages(ctx, userID, messages)
+	for _, e := range restored {
+		summary.Restored++
+		undone = append(undone, journal.Entry{
+			RunID:     runID,
+			Owner:     owner,
+			Time:      time.Now().UTC(),
+			Action:    journal.ActionUndo,
+			ThreadID:  e.ThreadID,
+			MessageID: e.MessageID,
+		})
+	}
+	summary.FailedThreads = append(summary.FailedThreads, failed...)
+	summary.Failed = len(summary.FailedThreads)
+
+	log.Info("Completed undo of cleanup run",
+		zap.Int("restored_count", summary.Restored),
+		zap.Int("failed_count", summary.Failed),
+		zap.Int("not_restorable_count", summary.NotRestorable),
+	)
+	return summary, nil
+}
+
+// revert undoes the change recorded in e, a thread-level entry written before
+// changes were journaled per message.
+func (s *CleanerService) revert(ctx context.Context, userID string, e journal.Entry) error {
+	var remove []string
+	for _, l := range e.AddedLabels {
+		if l == "TRASH" {
+			if err := s.gmail.UntrashThread(ctx, userID, e.ThreadID); err != nil {
+				return err
+			}
+			continue
+		}
+		remove = append(remove, l)
+	}
+	if len(e.RemovedLabels) == 0 && len(remove) == 0 {
+		return nil
+	}
+	return s.gmail.ModifyThread(ctx, userID, e.ThreadID, e.RemovedLabels, remove)
+}
+
+// revertMessages undoes message-level entries with one batch request per
+// distinct label change, as they can number in the thousands. It returns the
+// entries reverted and the messages that could not be restored.
+func (s *CleanerService) revertMessages(ctx context.Context, userID string, entries []journal.Entry) ([]journal.Entry, []*FailedThread) {
+	type change struct {
+		add, remove []string
+		entries     []journal.Entry
+	}
+	var changes []*change
+	byLabels := make(map[string]*change)
+	for _, e := range entries {
+		key := strings.Join(e.RemovedLabels, ",") + "|" + strings.Join(e.AddedLabels, ",")
+		c, ok := byLabels[key]
+		if !ok {
+			c = &change{add: e.RemovedLabels, remove: e.AddedLabels}
+			byLabels[key] = c
+			changes = append(changes, c)
+		}
+		c.entries = append(c.entries, e)
+	}
+
+	var reverted []journal.Entry
+	var failed []*FailedThread
+	for _, c := range changes {
+		ids := make([]string, len(c.entries))
+		for i, e := range c.entries {
+			ids[i] = e.MessageID
+		}
+		if err := s.gmail.BatchModifyMessages(ctx, userID, ids, c.add, c.remove); err != nil {
+			logger.L().Warn("Failed to restore messages", zap.Int("message_count", len(ids)), zap.Error(err))
+			for _, e := range c.entries {
+				failed = append(failed, &FailedThread{
+					ThreadID:  e.ThreadID,
+					MessageID: e.MessageID,
+					Reason:    err.Error(),
+					Code:      gmail.Code(err),
+				})
+			}
+			continue
+		}
+		reverted = append(reverted, c.entries...)
+	}
+	return reverted, failed
+}
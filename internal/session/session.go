@@ -0,0 +1,266 @@
+// Package session keeps signed-in users' OAuth tokens on the server. Browsers
+// only hold an opaque session ID in an HttpOnly cookie.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"mailcleanerpro/pkg/auth"
+	"mailcleanerpro/pkg/gmail"
+)
+
+// CookieName is the name of the session cookie.
+const CookieName = "mailcleaner_session"
+
+// DefaultTTL is how long a session lasts when no TTL is configured.
+const DefaultTTL = 7 * 24 * time.Hour
+
+// ErrNotFound is returned for unknown and expired sessions.
+var ErrNotFound = errors.New("session not found")
+
+// Session is a signed-in user.
+type Session struct {
+	// ID is the session's ID. It is only set on the copies the Store returns.
+	ID      string `json:"-"`
+	UserID  string `json:"user_id"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Picture string `json:"picture"`
+	// Scopes are the OAuth scopes granted to the app.
+	Scopes    []string      `json:"scopes"`
+	Token     *oauth2.Token `json:"-"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// Owner returns the key that jobs, journals and retention policies created in
+// the session are recorded under: the account's normalized email address, as
+// also returned by the session's Gmail client.
+func (s *Session) Owner() string {
+	return gmail.NormalizeAccount(s.Email)
+}
+
+// Config holds optional Store settings.
+type Config struct {
+	// TTL is how long a session lasts after sign-in.
+	TTL time.Duration
+	// CookieSecure restricts the session cookie to HTTPS. Browsers treat
+	// http://localhost as secure, so it can stay on for local development.
+	CookieSecure bool
+	// Tokens, if set, persists every session's token by Google user ID, so
+	// that it survives the session and server restarts.
+	Tokens auth.TokenStore
+}
+
+// DefaultConfig returns the default session settings.
+func DefaultConfig() Config {
+	return Config{TTL: DefaultTTL, CookieSecure: true}
+}
+
+// Store keeps sessions in memory, keyed by a hash of their ID so that the IDs
+// handed out in cookies are not kept. It is safe for concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	config   Config
+	sessions map[string]*Session
+}
+
+// NewStore creates a Store. A nil config uses DefaultConfig.
+func NewStore(config *Config) *Store {
+	cfg := DefaultConfig()
+	if config != nil {
+		cfg = *config
+		if cfg.TTL <= 0 {
+			cfg.TTL = DefaultTTL
+		}
+	}
+	return &Store{config: cfg, sessions: make(map[string]*Session)}
+}
+
+func key(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create starts a session for user holding token, and returns its ID. If
+// token comes without a refresh token, the one stored for the user is kept.
+func (s *Store) Create(user *auth.UserInfo, token *oauth2.Token) (string, *Session, error) {
+	if s.config.Tokens != nil {
+		token = s.mergeStored(user.ID, token)
+		if err := s.config.Tokens.Save(context.Background(), user.ID, token); err != nil {
+			return "", nil, fmt.Errorf("save token: %w", err)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("generate session ID: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	sess := &Session{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Name:      user.Name,
+		Picture:   user.Picture,
+		Scopes:    auth.GrantedScopes(token),
+		Token:     token,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.config.TTL),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, old := range s.sessions {
+		if now.After(old.ExpiresAt) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[key(id)] = sess
+	return id, sess.clone(id), nil
+}
+
+// Get returns a copy of the session with the given ID.
+func (s *Store) Get(id string) (*Session, error) {
+	if id == "" {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(id)
+	sess, ok := s.sessions[k]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		delete(s.sessions, k)
+		return nil, ErrNotFound
+	}
+	return sess.clone(id), nil
+}
+
+// SetToken replaces the OAuth token of the session with the given ID, e.g.
+// after it was refreshed, and persists it. A token without a refresh token
+// keeps the one already stored.
+func (s *Store) SetToken(id string, token *oauth2.Token) error {
+	s.mu.Lock()
+	sess, ok := s.sessions[key(id)]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	t := *token
+	if t.RefreshToken == "" && sess.Token != nil {
+		t.RefreshToken = sess.Token.RefreshToken
+	}
+	sess.Token = &t
+	userID := sess.UserID
+	s.mu.Unlock()
+
+	if s.config.Tokens == nil {
+		return nil
+	}
+	if err := s.config.Tokens.Save(context.Background(), userID, &t); err != nil {
+		return fmt.Errorf("save token: %w", err)
+	}
+	return nil
+}
+
+// mergeStored returns token with the refresh token stored for userID filled
+// in, if token has none. Google only issues a refresh token on first consent.
+func (s *Store) mergeStored(userID string, token *oauth2.Token) *oauth2.Token {
+	if token.RefreshToken != "" {
+		return token
+	}
+	stored, err := s.config.Tokens.Get(context.Background(), userID)
+	if err != nil || stored.RefreshToken == "" {
+		return token
+	}
+	t := *token
+	t.RefreshToken = stored.RefreshToken
+	return &t
+}
+
+// Delete ends the session with the given ID.
+func (s *Store) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, key(id))
+}
+
+// DeleteUser ends every session of userID and removes the user's stored token.
+func (s *Store) DeleteUser(userID string) error {
+	s.mu.Lock()
+	for k, sess := range s.sessions {
+		if sess.UserID == userID {
+			delete(s.sessions, k)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.config.Tokens == nil {
+		return nil
+	}
+	if err := s.config.Tokens.Delete(context.Background(), userID); err != nil {
+		return fmt.Errorf("delete token: %w", err)
+	}
+	return nil
+}
+
+// FromRequest returns the session referenced by the request's session cookie.
+func (s *Store) FromRequest(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return s.Get(cookie.Value)
+}
+
+// SetCookie sets the session cookie for id on w.
+func (s *Store) SetCookie(w http.ResponseWriter, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(s.config.TTL / time.Second),
+		HttpOnly: true,
+		Secure:   s.config.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearCookie removes the session cookie from the browser.
+func (s *Store) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.config.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (sess *Session) clone(id string) *Session {
+	c := *sess
+	c.ID = id
+	c.Scopes = append([]string(nil), sess.Scopes...)
+	if sess.Token != nil {
+		t := *sess.Token
+		c.Token = &t
+	}
+	return &c
+}
@@ -6,17 +6,66 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+
+	"mailcleanerpro/pkg/gmail"
 )
 
 const (
-	ScopeGmailModify  = "https://www.googleapis.com/auth/gmail.modify"
-	ScopeGmailFull    = "https://mail.google.com/"
-	GoogleUserInfoAPI = "https://www.googleapis.com/oauth2/v2/userinfo"
+	ScopeGmailReadonly = "https://www.googleapis.com/auth/gmail.readonly"
+	ScopeGmailModify   = "https://www.googleapis.com/auth/gmail.modify"
+	ScopeGmailFull     = "https://mail.google.com/"
+	GoogleUserInfoAPI  = "https://www.googleapis.com/oauth2/v2/userinfo"
 )
 
+// DefaultAccess is the scope profile requested when a login names none. It
+// is enough to trash, archive and label mail, but not to delete it
+// permanently.
+const DefaultAccess = gmail.AccessModify
+
+// identityScopes are requested with every scope profile.
+var identityScopes = []string{"openid", "email", "profile"}
+
+// ScopesForAccess returns the OAuth scopes of a scope profile.
+func ScopesForAccess(a gmail.Access) []string {
+	var scope string
+	switch a {
+	case gmail.AccessReadOnly:
+		scope = ScopeGmailReadonly
+	case gmail.AccessFull:
+		scope = ScopeGmailFull
+	default:
+		scope = ScopeGmailModify
+	}
+	return append([]string{scope}, identityScopes...)
+}
+
+// AccessForScopes returns the scope profile the granted scopes amount to.
+func AccessForScopes(scopes []string) gmail.Access {
+	access := gmail.AccessUnknown
+	for _, s := range scopes {
+		switch {
+		case s == ScopeGmailFull:
+			return gmail.AccessFull
+		case s == ScopeGmailModify:
+			access = gmail.AccessModify
+		case s == ScopeGmailReadonly && access < gmail.AccessReadOnly:
+			access = gmail.AccessReadOnly
+		}
+	}
+	return access
+}
+
+// GrantedScopes returns the scopes Google granted with token, which include
+// scopes granted by earlier logins when include_granted_scopes was set.
+func GrantedScopes(token *oauth2.Token) []string {
+	scope, _ := token.Extra("scope").(string)
+	return strings.Fields(scope)
+}
+
 // UserInfo represents the user information from Google OAuth
 type UserInfo struct {
 	ID            string `json:"id"`
@@ -36,8 +85,12 @@ type AuthResponse struct {
 	TokenType    string    `json:"token_type"`
 	ExpiresIn    int       `json:"expires_in"`
 	UserInfo     *UserInfo `json:"user_info"`
+	// Token is the token the fields above were taken from, kept server-side.
+	Token *oauth2.Token `json:"-"`
 }
 
+// NewGoogleOAuth2Config returns the OAuth2 config of the app, requesting the
+// scopes of DefaultAccess.
 func NewGoogleOAuth2Config() (*oauth2.Config, error) {
 	clientID := os.Getenv("GOOGLE_CLIENT_ID")
 	clientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
@@ -49,7 +102,7 @@ func NewGoogleOAuth2Config() (*oauth2.Config, error) {
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		RedirectURL:  redirectURL,
-		Scopes:       []string{ScopeGmailFull, "openid", "email", "profile"},
+		Scopes:       ScopesForAccess(DefaultAccess),
 		Endpoint:     google.Endpoint,
 	}, nil
 }
@@ -90,9 +143,10 @@ func GetUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
 	return &userInfo, nil
 }
 
-// ExchangeCodeWithUserInfo exchanges code for token and retrieves user info
-func ExchangeCodeWithUserInfo(ctx context.Context, conf *oauth2.Config, code string) (*AuthResponse, error) {
-	token, err := conf.Exchange(ctx, code)
+// ExchangeCodeWithUserInfo exchanges code for token and retrieves user info.
+// opts are passed to the exchange, e.g. the PKCE verifier.
+func ExchangeCodeWithUserInfo(ctx context.Context, conf *oauth2.Config, code string, opts ...oauth2.AuthCodeOption) (*AuthResponse, error) {
+	token, err := conf.Exchange(ctx, code, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("exchanging code: %w", err)
 	}
@@ -108,5 +162,6 @@ func ExchangeCodeWithUserInfo(ctx context.Context, conf *oauth2.Config, code str
 		TokenType:    token.TokenType,
 		ExpiresIn:    int(token.Expiry.Unix()),
 		UserInfo:     userInfo,
+		Token:        token,
 	}, nil
 }
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GoogleRevokeURL is Google's OAuth token revocation endpoint.
+const GoogleRevokeURL = "https://oauth2.googleapis.com/revoke"
+
+// ErrTokenInvalid is returned by RevokeToken when Google does not know the
+// token, typically because it was already revoked or has expired.
+var ErrTokenInvalid = errors.New("auth: token already revoked or expired")
+
+var revokeClient = &http.Client{Timeout: 15 * time.Second}
+
+// RevokeToken revokes token at revokeURL, GoogleRevokeURL when empty.
+// Revoking a refresh token also revokes its access tokens, and with them the
+// app's access to the account.
+func RevokeToken(ctx context.Context, revokeURL, token string) error {
+	if revokeURL == "" {
+		revokeURL = GoogleRevokeURL
+	}
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := revokeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("revoking token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+	if resp.StatusCode == http.StatusBadRequest && body.Error == "invalid_token" {
+		return ErrTokenInvalid
+	}
+	return fmt.Errorf("revoking token: unexpected status code %d: %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+}
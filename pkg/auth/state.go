@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// StateCookieName is the name of the cookie carrying a login in progress.
+const StateCookieName = "oauthstate"
+
+// DefaultStateTTL is how long a user has to complete a login.
+const DefaultStateTTL = 10 * time.Minute
+
+// ErrInvalidState is returned by LoginFlow.Complete when the login state is
+// missing, forged, expired, already used or does not match the callback.
+var ErrInvalidState = errors.New("auth: invalid OAuth state")
+
+// ErrReturnToNotAllowed is returned by LoginFlow.Begin for return-to URLs
+// outside the allowlist.
+var ErrReturnToNotAllowed = errors.New("auth: return_to URL not allowed")
+
+// LoginState is what a login remembers between /auth/login and the callback.
+type LoginState struct {
+	State string `json:"state"`
+	// Verifier is the PKCE code verifier sent with the code exchange.
+	Verifier string `json:"verifier"`
+	// Nonce must come back in the OpenID id_token.
+	Nonce string `json:"nonce"`
+	// ReturnTo is where the browser goes once signed in.
+	ReturnTo  string    `json:"return_to"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoginFlowConfig holds optional LoginFlow settings.
+type LoginFlowConfig struct {
+	// Secret signs state cookies. A random secret is used when empty, so
+	// logins in progress do not survive a restart.
+	Secret []byte
+	// TTL is how long a login may take.
+	TTL time.Duration
+	// CookieSecure restricts the state cookie to HTTPS.
+	CookieSecure bool
+	// ReturnToAllowlist lists absolute URL prefixes, e.g.
+	// "https://app.example.com/", allowed as return-to URLs. Paths on this
+	// server are always allowed.
+	ReturnToAllowlist []string
+}
+
+// LoginFlow keeps the state of logins in progress in short-lived signed
+// cookies and makes sure each is used only once. It is safe for concurrent use.
+type LoginFlow struct {
+	secret []byte
+	ttl    time.Duration
+	secure bool
+	allow  []*url.URL
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewLoginFlow creates a LoginFlow. A nil config uses the defaults.
+func NewLoginFlow(config *LoginFlowConfig) (*LoginFlow, error) {
+	var cfg LoginFlowConfig
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultStateTTL
+	}
+	if len(cfg.Secret) == 0 {
+		cfg.Secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.Secret); err != nil {
+			return nil, fmt.Errorf("generate state secret: %w", err)
+		}
+	}
+	f := &LoginFlow{secret: cfg.Secret, ttl: cfg.TTL, secure: cfg.CookieSecure, used: make(map[string]time.Time)}
+	for _, raw := range cfg.ReturnToAllowlist {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid return_to allowlist entry %q", raw)
+		}
+		f.allow = append(f.allow, u)
+	}
+	return f, nil
+}
+
+// Begin starts a login that returns to returnTo, sets its state cookie on w
+// and returns the URL to send the user to. opts are added to the URL.
+func (f *LoginFlow) Begin(w http.ResponseWriter, conf *oauth2.Config, returnTo string, opts ...oauth2.AuthCodeOption) (string, error) {
+	returnTo, ok := f.allowedReturnTo(returnTo)
+	if !ok {
+		return "", ErrReturnToNotAllowed
+	}
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	ls := &LoginState{
+		State:     state,
+		Verifier:  oauth2.GenerateVerifier(),
+		Nonce:     nonce,
+		ReturnTo:  returnTo,
+		ExpiresAt: time.Now().Add(f.ttl).UTC(),
+	}
+	value, err := f.sign(ls)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookieName,
+		Value:    value,
+		Path:     "/auth/",
+		MaxAge:   int(f.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   f.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	opts = append(opts,
+		oauth2.S256ChallengeOption(ls.Verifier),
+		oauth2.SetAuthURLParam("nonce", ls.Nonce),
+	)
+	return conf.AuthCodeURL(ls.State, opts...), nil
+}
+
+// Complete checks the state of the callback request r against its state
+// cookie, clears the cookie and returns the login's state. Each state is only
+// accepted once.
+func (f *LoginFlow) Complete(w http.ResponseWriter, r *http.Request) (*LoginState, error) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookieName,
+		Value:    "",
+		Path:     "/auth/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   f.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	cookie, err := r.Cookie(StateCookieName)
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	ls, err := f.verify(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	query := r.URL.Query().Get("state")
+	if now.After(ls.ExpiresAt) || !hmac.Equal([]byte(query), []byte(ls.State)) {
+		return nil, ErrInvalidState
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for state, expires := range f.used {
+		if now.After(expires) {
+			delete(f.used, state)
+		}
+	}
+	if _, dup := f.used[ls.State]; dup {
+		return nil, ErrInvalidState
+	}
+	f.used[ls.State] = ls.ExpiresAt
+	return ls, nil
+}
+
+func (f *LoginFlow) sign(ls *LoginState) (string, error) {
+	payload, err := json.Marshal(ls)
+	if err != nil {
+		return "", fmt.Errorf("encode login state: %w", err)
+	}
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (f *LoginFlow) verify(value string) (*LoginState, error) {
+	p, s, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidState
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidState
+	}
+	var ls LoginState
+	if err := json.Unmarshal(payload, &ls); err != nil {
+		return nil, ErrInvalidState
+	}
+	return &ls, nil
+}
+
+// allowedReturnTo returns the URL to return to after login: "/" for an empty
+// returnTo, a path on this server, or a URL under an allowlisted prefix.
+func (f *LoginFlow) allowedReturnTo(returnTo string) (string, bool) {
+	if returnTo == "" {
+		return "/", true
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return "", false
+	}
+	// A local path; "//host" and "/\host" would be taken as another host.
+	if u.Scheme == "" && u.Host == "" && u.User == nil && strings.HasPrefix(returnTo, "/") &&
+		!strings.HasPrefix(returnTo, "//") && !strings.HasPrefix(returnTo, "/\\") {
+		return returnTo, true
+	}
+	for _, a := range f.allow {
+		if strings.EqualFold(u.Scheme, a.Scheme) && strings.EqualFold(u.Host, a.Host) &&
+			u.User == nil && strings.HasPrefix(u.Path, a.Path) {
+			return returnTo, true
+		}
+	}
+	return "", false
+}
+
+// randomString returns 256 random bits, base64url-encoded.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate login state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func newTestLoginFlow(t *testing.T, allow ...string) *LoginFlow {
+	t.Helper()
+	f, err := NewLoginFlow(&LoginFlowConfig{Secret: []byte("test secret"), ReturnToAllowlist: allow})
+	if err != nil {
+		t.Fatalf("NewLoginFlow() = %v", err)
+	}
+	return f
+}
+
+func TestAllowedReturnTo(t *testing.T) {
+	f := newTestLoginFlow(t, "https://app.example.com/dashboard/")
+	tests := []struct {
+		returnTo string
+		want     string
+		ok       bool
+	}{
+		{"", "/", true},
+		{"/", "/", true},
+		{"/jobs?id=1#top", "/jobs?id=1#top", true},
+		{"//evil.example", "", false},
+		{"/\\evil.example", "", false},
+		{"evil.example/path", "", false},
+		{"https://app.example.com/dashboard/jobs", "https://app.example.com/dashboard/jobs", true},
+		{"HTTPS://APP.EXAMPLE.COM/dashboard/", "HTTPS://APP.EXAMPLE.COM/dashboard/", true},
+		{"https://app.example.com/admin", "", false},
+		{"http://app.example.com/dashboard/", "", false},
+		{"https://app.example.com.evil.example/dashboard/", "", false},
+		{"https://user@app.example.com/dashboard/", "", false},
+		{"javascript:alert(1)", "", false},
+		{"https://app.example.com/%zz", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.returnTo, func(t *testing.T) {
+			got, ok := f.allowedReturnTo(tt.returnTo)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("allowedReturnTo(%q) = %q, %v; want %q, %v", tt.returnTo, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f := newTestLoginFlow(t)
+	other := newTestLoginFlow(t)
+	other.secret = []byte("another secret")
+
+	ls := &LoginState{State: "s", Verifier: "v", Nonce: "n", ReturnTo: "/", ExpiresAt: time.Now().Add(time.Minute).UTC()}
+	valid, err := f.sign(ls)
+	if err != nil {
+		t.Fatalf("sign() = %v", err)
+	}
+	forged, err := other.sign(ls)
+	if err != nil {
+		t.Fatalf("sign() = %v", err)
+	}
+	payload, sig, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"empty", "", false},
+		{"no signature", payload, false},
+		{"signed with another secret", forged, false},
+		{"tampered payload", payload + "x." + sig, false},
+		{"tampered signature", payload + "." + sig[:len(sig)-2] + "AA", false},
+		{"bad encoding", "!!!." + sig, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.verify(tt.value)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidState) {
+					t.Errorf("verify() = %v, want %v", err, ErrInvalidState)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify() = %v", err)
+			}
+			if got.State != ls.State || got.Nonce != ls.Nonce || got.Verifier != ls.Verifier {
+				t.Errorf("verify() = %+v, want %+v", got, ls)
+			}
+		})
+	}
+}
+
+func TestBeginComplete(t *testing.T) {
+	conf := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example/auth"}}
+	f := newTestLoginFlow(t)
+
+	begin := httptest.NewRecorder()
+	authURL, err := f.Begin(begin, conf, "/jobs")
+	if err != nil {
+		t.Fatalf("Begin() = %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("state") == "" || q.Get("nonce") == "" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("auth URL %q lacks state, nonce or PKCE challenge", authURL)
+	}
+	cookie := begin.Result().Cookies()[0]
+
+	callback := func(state string, cookies ...*http.Cookie) (*LoginState, error) {
+		r := httptest.NewRequest(http.MethodGet, "/auth/callback?code=c&state="+url.QueryEscape(state), nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return f.Complete(httptest.NewRecorder(), r)
+	}
+
+	tests := []struct {
+		name    string
+		state   string
+		cookies []*http.Cookie
+		ok      bool
+	}{
+		{"no cookie", q.Get("state"), nil, false},
+		{"state mismatch", "other", []*http.Cookie{cookie}, false},
+		{"valid", q.Get("state"), []*http.Cookie{cookie}, true},
+		{"replayed", q.Get("state"), []*http.Cookie{cookie}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls, err := callback(tt.state, tt.cookies...)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidState) {
+					t.Errorf("Complete() = %v, want %v", err, ErrInvalidState)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete() = %v", err)
+			}
+			if ls.ReturnTo != "/jobs" || ls.Nonce != q.Get("nonce") {
+				t.Errorf("Complete() = %+v, want return_to /jobs and the URL's nonce", ls)
+			}
+		})
+	}
+}
+
+func TestBeginRejectsReturnTo(t *testing.T) {
+	f := newTestLoginFlow(t)
+	if _, err := f.Begin(httptest.NewRecorder(), &oauth2.Config{}, "https://evil.example/"); !errors.Is(err, ErrReturnToNotAllowed) {
+		t.Errorf("Begin() = %v, want %v", err, ErrReturnToNotAllowed)
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// SaveTokenFunc stores a token after it was refreshed.
+type SaveTokenFunc func(*oauth2.Token) error
+
+// persistingTokenSource refreshes tokens through conf's token source and
+// hands every new token to save.
+type persistingTokenSource struct {
+	base    oauth2.TokenSource
+	save    SaveTokenFunc
+	onError func(error)
+
+	mu   sync.Mutex
+	last string
+}
+
+// TokenSource returns a token source that starts from token and refreshes it
+// with its refresh token once it expires. Each refreshed token, including a
+// rotated refresh token, is passed to save. A failing save is reported to
+// onError, if set, but does not fail the request that needed the token.
+func TokenSource(ctx context.Context, conf *oauth2.Config, token *oauth2.Token, save SaveTokenFunc, onError func(error)) oauth2.TokenSource {
+	return &persistingTokenSource{
+		base:    conf.TokenSource(ctx, token),
+		save:    save,
+		onError: onError,
+		last:    token.AccessToken,
+	}
+}
+
+// Token returns a valid token, refreshing and saving it if needed.
+func (ts *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := ts.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if tok.AccessToken == ts.last {
+		return tok, nil
+	}
+	ts.last = tok.AccessToken
+	if err := ts.save(tok); err != nil && ts.onError != nil {
+		ts.onError(err)
+	}
+	return tok, nil
+}
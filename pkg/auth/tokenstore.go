@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrTokenNotFound is returned by TokenStore.Get for users without a token.
+var ErrTokenNotFound = errors.New("auth: token not found")
+
+// TokenStore keeps users' OAuth tokens encrypted at rest, keyed by Google
+// user ID (UserInfo.ID). Implementations are safe for concurrent use.
+type TokenStore interface {
+	// Get returns the token of userID, or ErrTokenNotFound.
+	Get(ctx context.Context, userID string) (*oauth2.Token, error)
+	// Save stores token for userID, replacing any previous token.
+	Save(ctx context.Context, userID string, token *oauth2.Token) error
+	// Delete removes the token of userID. Deleting a missing token is not an error.
+	Delete(ctx context.Context, userID string) error
+	// Rotate re-encrypts tokens sealed with an older key under the primary
+	// key, and returns how many were re-encrypted.
+	Rotate(ctx context.Context) (int, error)
+	Close() error
+}
+
+// Token store backends.
+const (
+	TokenStoreFile   = "file"
+	TokenStoreSQLite = "sqlite"
+)
+
+// Default token store locations by backend.
+const (
+	DefaultTokenFilePath   = "data/tokens.json"
+	DefaultTokenSQLitePath = "data/tokens.db"
+)
+
+// OpenTokenStore opens a token store of the given backend at path. An empty
+// backend is TokenStoreFile; an empty path uses the backend's default.
+func OpenTokenStore(backend, path string, keys *Keyring) (TokenStore, error) {
+	switch backend {
+	case "", TokenStoreFile:
+		return NewFileTokenStore(path, keys)
+	case TokenStoreSQLite:
+		return openSQLiteTokenStore(path, keys)
+	default:
+		return nil, fmt.Errorf("unknown token store backend %q", backend)
+	}
+}
+
+// Key is an AES-256 key used to encrypt tokens. ID is stored with every
+// token it encrypts, so that the key can be found again after rotation.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring encrypts tokens with AES-GCM. New tokens are sealed with the
+// primary key; the other keys are only used to open tokens sealed before a
+// rotation.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a Keyring. The first key is the primary key.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no token encryption key")
+	}
+	k := &Keyring{primary: keys[0].ID, aeads: make(map[string]cipher.AEAD)}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("token encryption key without ID")
+		}
+		if _, dup := k.aeads[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate token encryption key %q", key.ID)
+		}
+		if len(key.Secret) != 32 {
+			return nil, fmt.Errorf("token encryption key %q must be 32 bytes, got %d", key.ID, len(key.Secret))
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("token encryption key %q: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("token encryption key %q: %w", key.ID, err)
+		}
+		k.aeads[key.ID] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring parses keys written as comma-separated "id:base64-secret"
+// pairs, primary key first, e.g. "2:<new key>,1:<old key>".
+func ParseKeyring(spec string) (*Keyring, error) {
+	var keys []Key
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("token encryption key %q is not id:base64-secret", id)
+		}
+		b, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("token encryption key %q: %w", id, err)
+		}
+		keys = append(keys, Key{ID: id, Secret: b})
+	}
+	return NewKeyring(keys...)
+}
+
+// sealedToken is an encrypted token as backends store it.
+type sealedToken struct {
+	KeyID      string    `json:"key_id"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// seal encrypts token with the primary key. The user ID is authenticated
+// along with it, so a token copied to another user fails to open.
+func (k *Keyring) seal(userID string, token *oauth2.Token) (*sealedToken, error) {
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return nil, fmt.Errorf("encode token: %w", err)
+	}
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return &sealedToken{
+		KeyID:      k.primary,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plain, []byte(userID)),
+		UpdatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// open decrypts a token sealed for userID.
+func (k *Keyring) open(userID string, st *sealedToken) (*oauth2.Token, error) {
+	aead, ok := k.aeads[st.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("token of user %s is encrypted with unknown key %q", userID, st.KeyID)
+	}
+	plain, err := aead.Open(nil, st.Nonce, st.Ciphertext, []byte(userID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt token of user %s: %w", userID, err)
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(plain, &token); err != nil {
+		return nil, fmt.Errorf("decode token of user %s: %w", userID, err)
+	}
+	return &token, nil
+}
+
+// reseal re-encrypts st under the primary key. It returns nil if st already
+// uses it.
+func (k *Keyring) reseal(userID string, st *sealedToken) (*sealedToken, error) {
+	if st.KeyID == k.primary {
+		return nil, nil
+	}
+	token, err := k.open(userID, st)
+	if err != nil {
+		return nil, err
+	}
+	return k.seal(userID, token)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// FileTokenStore keeps encrypted tokens in a JSON file.
+type FileTokenStore struct {
+	mu     sync.Mutex
+	path   string
+	keys   *Keyring
+	tokens map[string]*sealedToken
+}
+
+// NewFileTokenStore opens the token file at path, creating it on first save.
+// An empty path uses DefaultTokenFilePath.
+func NewFileTokenStore(path string, keys *Keyring) (*FileTokenStore, error) {
+	if path == "" {
+		path = DefaultTokenFilePath
+	}
+	s := &FileTokenStore{path: path, keys: keys, tokens: make(map[string]*sealedToken)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read token store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("parse token store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileTokenStore) Get(ctx context.Context, userID string) (*oauth2.Token, error) {
+	s.mu.Lock()
+	st, ok := s.tokens[userID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return s.keys.open(userID, st)
+}
+
+func (s *FileTokenStore) Save(ctx context.Context, userID string, token *oauth2.Token) error {
+	st, err := s.keys.seal(userID, token)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[userID] = st
+	return s.save()
+}
+
+func (s *FileTokenStore) Delete(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[userID]; !ok {
+		return nil
+	}
+	delete(s.tokens, userID)
+	return s.save()
+}
+
+func (s *FileTokenStore) Rotate(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for userID, st := range s.tokens {
+		resealed, err := s.keys.reseal(userID, st)
+		if err != nil {
+			return n, err
+		}
+		if resealed != nil {
+			s.tokens[userID] = resealed
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
+
+func (s *FileTokenStore) Close() error { return nil }
+
+// save writes all tokens to disk, replacing the file atomically. The caller
+// must hold s.mu.
+func (s *FileTokenStore) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode token store: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("create token store directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write token store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write token store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite
+
+package auth
+
+import "fmt"
+
+// openSQLiteTokenStore fails in builds without the "sqlite" tag, which leave
+// out the cgo SQLite driver.
+func openSQLiteTokenStore(path string, keys *Keyring) (TokenStore, error) {
+	return nil, fmt.Errorf("the %q token store backend is not included in this build; rebuild with -tags sqlite (requires cgo)", TokenStoreSQLite)
+}
@@ -0,0 +1,152 @@
+//go:build sqlite
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/oauth2"
+)
+
+const sqliteTokenSchema = `
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+	user_id    TEXT PRIMARY KEY,
+	key_id     TEXT NOT NULL,
+	nonce      BLOB NOT NULL,
+	ciphertext BLOB NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+)`
+
+// SQLiteTokenStore keeps encrypted tokens in an embedded SQLite database. The
+// driver needs cgo, so the backend is only built with the "sqlite" build tag.
+type SQLiteTokenStore struct {
+	db   *sql.DB
+	keys *Keyring
+}
+
+// NewSQLiteTokenStore opens or creates the SQLite database at path. An empty
+// path uses DefaultTokenSQLitePath.
+func NewSQLiteTokenStore(path string, keys *Keyring) (*SQLiteTokenStore, error) {
+	if path == "" {
+		path = DefaultTokenSQLitePath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create token store directory: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("open token store %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteTokenSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create token store schema: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("restrict token store permissions: %w", err)
+	}
+	return &SQLiteTokenStore{db: db, keys: keys}, nil
+}
+
+func openSQLiteTokenStore(path string, keys *Keyring) (TokenStore, error) {
+	return NewSQLiteTokenStore(path, keys)
+}
+
+func (s *SQLiteTokenStore) Get(ctx context.Context, userID string) (*oauth2.Token, error) {
+	var st sealedToken
+	err := s.db.QueryRowContext(ctx,
+		`SELECT key_id, nonce, ciphertext, updated_at FROM oauth_tokens WHERE user_id = ?`, userID,
+	).Scan(&st.KeyID, &st.Nonce, &st.Ciphertext, &st.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read token of user %s: %w", userID, err)
+	}
+	return s.keys.open(userID, &st)
+}
+
+func (s *SQLiteTokenStore) Save(ctx context.Context, userID string, token *oauth2.Token) error {
+	st, err := s.keys.seal(userID, token)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, s.db, userID, st)
+}
+
+func (s *SQLiteTokenStore) Delete(ctx context.Context, userID string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("delete token of user %s: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *SQLiteTokenStore) Rotate(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin key rotation: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT user_id, key_id, nonce, ciphertext, updated_at FROM oauth_tokens WHERE key_id <> ?`, s.keys.primary)
+	if err != nil {
+		return 0, fmt.Errorf("list tokens to rotate: %w", err)
+	}
+	stale := make(map[string]*sealedToken)
+	for rows.Next() {
+		var userID string
+		var st sealedToken
+		if err := rows.Scan(&userID, &st.KeyID, &st.Nonce, &st.Ciphertext, &st.UpdatedAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("list tokens to rotate: %w", err)
+		}
+		stale[userID] = &st
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("list tokens to rotate: %w", err)
+	}
+
+	for userID, st := range stale {
+		resealed, err := s.keys.reseal(userID, st)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.put(ctx, tx, userID, resealed); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit key rotation: %w", err)
+	}
+	return len(stale), nil
+}
+
+func (s *SQLiteTokenStore) Close() error { return s.db.Close() }
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *SQLiteTokenStore) put(ctx context.Context, db execer, userID string, st *sealedToken) error {
+	_, err := db.ExecContext(ctx, `
+INSERT INTO oauth_tokens (user_id, key_id, nonce, ciphertext, updated_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(user_id) DO UPDATE SET
+	key_id = excluded.key_id,
+	nonce = excluded.nonce,
+	ciphertext = excluded.ciphertext,
+	updated_at = excluded.updated_at`,
+		userID, st.KeyID, st.Nonce, st.Ciphertext, st.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("save token of user %s: %w", userID, err)
+	}
+	return nil
+}
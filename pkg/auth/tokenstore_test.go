@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func testKey(id string, fill byte) Key {
+	return Key{ID: id, Secret: bytes.Repeat([]byte{fill}, 32)}
+}
+
+func TestParseKeyring(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	tests := []struct {
+		spec        string
+		wantPrimary string
+		wantErr     string
+	}{
+		{spec: "1:" + secret, wantPrimary: "1"},
+		{spec: " 2:" + secret + " , 1:" + secret + ",", wantPrimary: "2"},
+		{spec: "", wantErr: "no token encryption key"},
+		{spec: secret, wantErr: "not id:base64-secret"},
+		{spec: ":" + secret, wantErr: "without ID"},
+		{spec: "1:" + secret + ",1:" + secret, wantErr: "duplicate"},
+		{spec: "1:" + short, wantErr: "must be 32 bytes"},
+		{spec: "1:not base64!", wantErr: "illegal base64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			k, err := ParseKeyring(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseKeyring() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseKeyring() = %v", err)
+			}
+			if k.primary != tt.wantPrimary {
+				t.Errorf("primary key = %q, want %q", k.primary, tt.wantPrimary)
+			}
+		})
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	k, err := NewKeyring(testKey("1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewKeyring(testKey("1", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer"}
+	st, err := k.seal("alice", token)
+	if err != nil {
+		t.Fatalf("seal() = %v", err)
+	}
+	if bytes.Contains(st.Ciphertext, []byte("refresh")) {
+		t.Fatal("sealed token contains the refresh token in the clear")
+	}
+
+	tampered := *st
+	tampered.Ciphertext = append([]byte(nil), st.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	unknownKey := *st
+	unknownKey.KeyID = "9"
+
+	tests := []struct {
+		name   string
+		keys   *Keyring
+		userID string
+		st     *sealedToken
+		ok     bool
+	}{
+		{"same user", k, "alice", st, true},
+		{"other user", k, "bob", st, false},
+		{"wrong secret", other, "alice", st, false},
+		{"tampered", k, "alice", &tampered, false},
+		{"unknown key ID", k, "alice", &unknownKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.open(tt.userID, tt.st)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("open() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("open() = %v", err)
+			}
+			if got.AccessToken != token.AccessToken || got.RefreshToken != token.RefreshToken {
+				t.Errorf("open() = %+v, want %+v", got, token)
+			}
+		})
+	}
+}
+
+func TestKeyringReseal(t *testing.T) {
+	oldKeys, err := NewKeyring(testKey("1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewKeyring(testKey("2", 2), testKey("1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+	old, err := oldKeys.seal("alice", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := rotated.reseal("alice", old)
+	if err != nil {
+		t.Fatalf("reseal() = %v", err)
+	}
+	if st == nil || st.KeyID != "2" {
+		t.Fatalf("reseal() = %+v, want a token sealed with key 2", st)
+	}
+	if got, err := rotated.open("alice", st); err != nil || got.RefreshToken != "refresh" {
+		t.Errorf("open() after reseal = %+v, %v", got, err)
+	}
+	if again, err := rotated.reseal("alice", st); again != nil || err != nil {
+		t.Errorf("reseal() of a current token = %+v, %v; want nil, nil", again, err)
+	}
+}
+
+func TestFileTokenStoreRotate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	oldKeys, err := NewKeyring(testKey("1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileTokenStore(path, oldKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx, "alice", &oauth2.Token{RefreshToken: "refresh"}); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+
+	rotated, err := NewKeyring(testKey("2", 2), testKey("1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFileTokenStore(path, rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Rotate(ctx); n != 1 || err != nil {
+		t.Fatalf("Rotate() = %d, %v; want 1, nil", n, err)
+	}
+
+	// The old key can now be dropped.
+	newKeys, err := NewKeyring(testKey("2", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFileTokenStore(path, newKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ctx, "alice"); err != nil || got.RefreshToken != "refresh" {
+		t.Errorf("Get() after rotation = %+v, %v", got, err)
+	}
+	if _, err := s.Get(ctx, "bob"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Get() of unknown user = %v, want %v", err, ErrTokenNotFound)
+	}
+}
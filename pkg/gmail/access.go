@@ -0,0 +1,70 @@
+package gmail
+
+import "fmt"
+
+// Access is what a token's OAuth scopes allow a Service to do.
+type Access int
+
+const (
+	// AccessUnknown means the granted scopes were not recorded. Nothing is
+	// rejected up front; Gmail reports missing scopes itself.
+	AccessUnknown Access = iota
+	// AccessReadOnly allows reading mail, e.g. for analytics and previews.
+	AccessReadOnly
+	// AccessModify also allows trashing, labelling and sending.
+	AccessModify
+	// AccessFull also allows permanent deletion.
+	AccessFull
+)
+
+// String returns the access level's name: "read_only", "modify" or "full".
+func (a Access) String() string {
+	switch a {
+	case AccessReadOnly:
+		return "read_only"
+	case AccessModify:
+		return "modify"
+	case AccessFull:
+		return "full"
+	}
+	return "unknown"
+}
+
+// ParseAccess parses an access level name as returned by Access.String.
+func ParseAccess(name string) (Access, error) {
+	for _, a := range []Access{AccessReadOnly, AccessModify, AccessFull} {
+		if name == a.String() {
+			return a, nil
+		}
+	}
+	return AccessUnknown, fmt.Errorf("unknown access level %q: want read_only, modify or full", name)
+}
+
+// AccessError is returned by Service.Require when the token's scopes do not
+// allow an operation. It matches ErrInsufficientScope.
+type AccessError struct {
+	Required Access
+	Granted  Access
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("%v: the operation needs %s access, but only %s access was granted", ErrInsufficientScope, e.Required, e.Granted)
+}
+
+func (e *AccessError) Unwrap() error { return ErrInsufficientScope }
+
+// SetAccess records what the token's scopes allow, so that Require can reject
+// operations before any Gmail call is made.
+func (s *Service) SetAccess(a Access) { s.access = a }
+
+// Access returns what the token's scopes allow, as set by SetAccess.
+func (s *Service) Access() Access { return s.access }
+
+// Require returns an *AccessError unless the token's scopes allow operations
+// needing access a.
+func (s *Service) Require(a Access) error {
+	if s.access == AccessUnknown || s.access >= a {
+		return nil
+	}
+	return &AccessError{Required: a, Granted: s.access}
+}
@@ -0,0 +1,364 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"mailcleanerpro/pkg/logger"
+)
+
+// maxBatchSize is the maximum number of message IDs accepted by a single
+// Users.Messages.BatchModify or Users.Messages.BatchDelete call.
+const maxBatchSize = 1000
+
+// ThreadMessage is a message found by ExpandThreads.
+type ThreadMessage struct {
+	ID       string
+	LabelIDs []string
+	// From is the message's From header.
+	From string
+}
+
+// ThreadResult is the outcome of a batch operation for a single thread.
+type ThreadResult struct {
+	ThreadID   string   `json:"thread_id"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+	// LabelIDs are the labels carried by any of the thread's messages before
+	// the operation.
+	LabelIDs []string         `json:"label_ids,omitempty"`
+	Messages []*ThreadMessage `json:"-"`
+	// Skipped is why the thread was left alone, if it was set before the
+	// operation. Skipped threads are neither succeeded nor failed.
+	Skipped string `json:"skipped,omitempty"`
+	Err     error  `json:"-"`
+	// Applied is the number of leading MessageIDs the operation was applied
+	// to although the thread failed. It can only be non-zero for threads too
+	// large for a single batch request.
+	Applied int `json:"-"`
+}
+
+// pending reports whether the thread is still to be processed.
+func (tr *ThreadResult) pending() bool { return tr.Err == nil && tr.Skipped == "" }
+
+// BatchResult holds the per-thread outcome of a batch operation.
+type BatchResult struct {
+	Results []*ThreadResult `json:"results"`
+}
+
+// Succeeded returns the IDs of threads whose messages were all processed.
+func (r *BatchResult) Succeeded() []string {
+	ids := make([]string, 0, len(r.Results))
+	for _, tr := range r.Pending() {
+		ids = append(ids, tr.ThreadID)
+	}
+	return ids
+}
+
+// Pending returns the results of threads that have neither failed nor been
+// skipped. Before an operation, these are the threads it will process.
+func (r *BatchResult) Pending() []*ThreadResult {
+	pending := make([]*ThreadResult, 0, len(r.Results))
+	for _, tr := range r.Results {
+		if tr.pending() {
+			pending = append(pending, tr)
+		}
+	}
+	return pending
+}
+
+// Skipped returns the results of threads that were left alone.
+func (r *BatchResult) Skipped() []*ThreadResult {
+	var skipped []*ThreadResult
+	for _, tr := range r.Results {
+		if tr.Err == nil && tr.Skipped != "" {
+			skipped = append(skipped, tr)
+		}
+	}
+	return skipped
+}
+
+// Failed returns the results of threads that could not be processed.
+func (r *BatchResult) Failed() []*ThreadResult {
+	var failed []*ThreadResult
+	for _, tr := range r.Results {
+		if tr.Err != nil {
+			failed = append(failed, tr)
+		}
+	}
+	return failed
+}
+
+// Err summarises the failures in r, or returns nil when every thread succeeded.
+func (r *BatchResult) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d threads failed, first failure on thread %s: %w",
+		len(failed), len(r.Results), failed[0].ThreadID, failed[0].Err)
+}
+
+// expandConcurrency is how many threads expandThreads fetches at once. Each
+// fetch still waits for quota in the Limiter.
+const expandConcurrency = 8
+
+// ExpandThreads resolves each thread ID to the messages it contains, with
+// their labels and senders, fetching up to expandConcurrency threads at once.
+// Results are in the order of threadIDs; threads that cannot be fetched are
+// returned with Err set. Callers may set Skipped on threads to leave alone
+// before passing the result to TrashExpanded, DeleteExpanded or
+// ModifyExpanded, which only touch the messages listed here.
+func (s *Service) ExpandThreads(ctx context.Context, userID string, threadIDs []string) *BatchResult {
+	result := &BatchResult{Results: make([]*ThreadResult, len(threadIDs))}
+	for i, tid := range threadIDs {
+		result.Results[i] = &ThreadResult{ThreadID: tid}
+	}
+
+	work := make(chan *ThreadResult)
+	var wg sync.WaitGroup
+	for i := 0; i < expandConcurrency && i < len(threadIDs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tr := range work {
+				s.expandThread(ctx, userID, tr)
+			}
+		}()
+	}
+	for _, tr := range result.Results {
+		work <- tr
+	}
+	close(work)
+	wg.Wait()
+
+	return result
+}
+
+// expandThread fills in the messages and label IDs of tr.ThreadID, or tr.Err.
+func (s *Service) expandThread(ctx context.Context, userID string, tr *ThreadResult) {
+	if err := ctx.Err(); err != nil {
+		tr.Err = err
+		return
+	}
+
+	var thread *gmail.Thread
+	err := s.do(ctx, "threads.get", func() (err error) {
+		thread, err = s.api.Users.Threads.Get(userID, tr.ThreadID).
+			Format("metadata").
+			MetadataHeaders("From").
+			Fields(googleapi.Field("id"), googleapi.Field("messages/id"), googleapi.Field("messages/labelIds"), googleapi.Field("messages/payload/headers")).
+			Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		logger.L().Error("Failed to expand thread into messages",
+			zap.String("user_id", userID),
+			zap.String("thread_id", tr.ThreadID),
+			zap.Error(err),
+		)
+		tr.Err = fmt.Errorf("failed to fetch messages of thread %s: %w", tr.ThreadID, err)
+		ReportProgress(ctx, ProgressEvent{
+			Type:      EventError,
+			Operation: "expand",
+			Error:     tr.Err.Error(),
+		})
+		return
+	}
+	labels := make(map[string]bool)
+	for _, m := range thread.Messages {
+		tr.MessageIDs = append(tr.MessageIDs, m.Id)
+		tr.Messages = append(tr.Messages, &ThreadMessage{
+			ID:       m.Id,
+			LabelIDs: m.LabelIds,
+			From:     header(m, "From"),
+		})
+		for _, l := range m.LabelIds {
+			if !labels[l] {
+				labels[l] = true
+				tr.LabelIDs = append(tr.LabelIDs, l)
+			}
+		}
+	}
+}
+
+// applyToExpanded invokes fn with chunks of at most maxBatchSize message IDs
+// of the pending threads of an expanded result. A failed chunk marks every
+// thread that had messages in it as failed. Each thread is kept in a single
+// chunk, so that a failure never leaves it partly changed, unless it is too
+// large for one: it then gets chunks of its own, stops at the first that
+// fails and records how many of its messages were changed in Applied.
+func (s *Service) applyToExpanded(ctx context.Context, userID, operation string, result *BatchResult, fn func(ids []string) error) {
+	log := logger.L()
+
+	var (
+		chunk        []string
+		chunkThreads []*ThreadResult
+		chunkCount   int
+		// done counts threads whose outcome is known; pending counts threads
+		// whose last messages are in the current chunk.
+		done    = len(result.Results) - len(result.Succeeded())
+		pending int
+	)
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		chunkCount++
+		chunkStart := time.Now()
+		err := fn(chunk)
+		if err != nil {
+			log.Error("Batch request failed",
+				zap.String("user_id", userID),
+				zap.String("operation", operation),
+				zap.Int("chunk_number", chunkCount),
+				zap.Int("message_count", len(chunk)),
+				zap.Int("thread_count", len(chunkThreads)),
+				zap.Duration("duration", time.Since(chunkStart)),
+				zap.Error(err),
+			)
+			for _, tr := range chunkThreads {
+				if tr.Err == nil {
+					tr.Err = fmt.Errorf("%s batch %d failed: %w", operation, chunkCount, err)
+				}
+			}
+			ReportProgress(ctx, ProgressEvent{
+				Type:      EventError,
+				Operation: operation,
+				Error:     err.Error(),
+			})
+		} else {
+			log.Info("Batch request completed",
+				zap.String("user_id", userID),
+				zap.String("operation", operation),
+				zap.Int("chunk_number", chunkCount),
+				zap.Int("message_count", len(chunk)),
+				zap.Int("thread_count", len(chunkThreads)),
+				zap.Duration("duration", time.Since(chunkStart)),
+			)
+		}
+		done += pending
+		pending = 0
+		ReportProgress(ctx, ProgressEvent{
+			Type:      EventBatchProgress,
+			Operation: operation,
+			Done:      done,
+			Total:     len(result.Results),
+		})
+		chunk = nil
+		chunkThreads = nil
+	}
+
+	for _, tr := range result.Results {
+		if !tr.pending() {
+			continue
+		}
+		ids := tr.MessageIDs
+		if len(chunk)+len(ids) > maxBatchSize {
+			flush()
+		}
+		if len(ids) <= maxBatchSize {
+			chunk = append(chunk, ids...)
+			chunkThreads = append(chunkThreads, tr)
+			pending++
+			if len(chunk) == maxBatchSize {
+				flush()
+			}
+			continue
+		}
+
+		for start := 0; start < len(ids); start += maxBatchSize {
+			end := min(start+maxBatchSize, len(ids))
+			chunk = append(chunk, ids[start:end]...)
+			chunkThreads = append(chunkThreads, tr)
+			if end == len(ids) {
+				pending++
+			}
+			flush()
+			if tr.Err != nil {
+				tr.Applied = start
+				if end < len(ids) {
+					done++
+				}
+				break
+			}
+		}
+	}
+	flush()
+}
+
+// BatchTrashMessages moves individual messages to trash with
+// Users.Messages.BatchModify in chunks of up to 1000 IDs, leaving the rest of
+// their threads alone. It returns the number of messages trashed, which
+// stops short at the first failed chunk.
+func (s *Service) BatchTrashMessages(ctx context.Context, userID string, messageIDs []string) (int, error) {
+	trashed := 0
+	for start := 0; start < len(messageIDs); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(messageIDs) {
+			end = len(messageIDs)
+		}
+		if err := s.BatchModifyMessages(ctx, userID, messageIDs[start:end], []string{"TRASH"}, []string{"INBOX"}); err != nil {
+			ReportProgress(ctx, ProgressEvent{
+				Type:      EventError,
+				Operation: "trash_messages",
+				Error:     err.Error(),
+			})
+			return trashed, err
+		}
+		trashed = end
+		ReportProgress(ctx, ProgressEvent{
+			Type:      EventBatchProgress,
+			Operation: "trash_messages",
+			Done:      trashed,
+			Total:     len(messageIDs),
+		})
+	}
+	return trashed, nil
+}
+
+// BatchModifyMessages adds and removes labels on individual messages with
+// Users.Messages.BatchModify in chunks of up to 1000 IDs.
+func (s *Service) BatchModifyMessages(ctx context.Context, userID string, messageIDs, addLabelIDs, removeLabelIDs []string) error {
+	for start := 0; start < len(messageIDs); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(messageIDs) {
+			end = len(messageIDs)
+		}
+		req := &gmail.BatchModifyMessagesRequest{
+			Ids:            messageIDs[start:end],
+			AddLabelIds:    addLabelIDs,
+			RemoveLabelIds: removeLabelIDs,
+		}
+		err := s.do(ctx, "messages.batchModify", func() error {
+			return s.api.Users.Messages.BatchModify(userID, req).Context(ctx).Do()
+		})
+		if err != nil {
+			return fmt.Errorf("batch modify of %d messages: %w", end-start, err)
+		}
+	}
+	return nil
+}
+
+// batchDeleteMessages permanently deletes messageIDs in chunks of maxBatchSize.
+func (s *Service) batchDeleteMessages(ctx context.Context, userID string, messageIDs []string) error {
+	for start := 0; start < len(messageIDs); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(messageIDs) {
+			end = len(messageIDs)
+		}
+		req := &gmail.BatchDeleteMessagesRequest{Ids: messageIDs[start:end]}
+		err := s.do(ctx, "messages.batchDelete", func() error {
+			return s.api.Users.Messages.BatchDelete(userID, req).Context(ctx).Do()
+		})
+		if err != nil {
+			return fmt.Errorf("batch delete of %d messages: %w", end-start, err)
+		}
+	}
+	return nil
+}
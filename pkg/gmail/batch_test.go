@@ -0,0 +1,105 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// expandedResult returns a result with one pending thread per size, whose
+// message IDs are "t<thread>m<message>".
+func expandedResult(sizes ...int) *BatchResult {
+	result := &BatchResult{}
+	for i, n := range sizes {
+		tr := &ThreadResult{ThreadID: fmt.Sprintf("t%d", i)}
+		for j := 0; j < n; j++ {
+			tr.MessageIDs = append(tr.MessageIDs, fmt.Sprintf("t%dm%d", i, j))
+		}
+		result.Results = append(result.Results, tr)
+	}
+	return result
+}
+
+func TestApplyToExpanded(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+		// failChunk is the 1-based chunk that fails, or 0.
+		failChunk   int
+		wantChunks  []int
+		wantFailed  []bool
+		wantApplied []int
+	}{
+		{
+			name:        "fits in one chunk",
+			sizes:       []int{400, 600},
+			wantChunks:  []int{1000},
+			wantFailed:  []bool{false, false},
+			wantApplied: []int{0, 0},
+		},
+		{
+			name:        "thread crossing the limit starts a new chunk",
+			sizes:       []int{600, 600},
+			wantChunks:  []int{600, 600},
+			wantFailed:  []bool{false, false},
+			wantApplied: []int{0, 0},
+		},
+		{
+			name:        "failed chunk only fails its own threads",
+			sizes:       []int{600, 600},
+			failChunk:   2,
+			wantChunks:  []int{600, 600},
+			wantFailed:  []bool{false, true},
+			wantApplied: []int{0, 0},
+		},
+		{
+			name:        "large thread gets chunks of its own",
+			sizes:       []int{10, 2500, 10},
+			wantChunks:  []int{10, 1000, 1000, 500, 10},
+			wantFailed:  []bool{false, false, false},
+			wantApplied: []int{0, 0, 0},
+		},
+		{
+			name:        "large thread stops at its first failed chunk",
+			sizes:       []int{10, 2500, 10},
+			failChunk:   3,
+			wantChunks:  []int{10, 1000, 1000, 10},
+			wantFailed:  []bool{false, true, false},
+			wantApplied: []int{0, 1000, 0},
+		},
+		{
+			name:        "empty thread",
+			sizes:       []int{0, 5},
+			wantChunks:  []int{5},
+			wantFailed:  []bool{false, false},
+			wantApplied: []int{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := expandedResult(tt.sizes...)
+			var chunks []int
+			(&Service{}).applyToExpanded(context.Background(), "me", "test", result, func(ids []string) error {
+				chunks = append(chunks, len(ids))
+				if len(chunks) == tt.failChunk {
+					return errors.New("batch failed")
+				}
+				return nil
+			})
+
+			if !reflect.DeepEqual(chunks, tt.wantChunks) {
+				t.Errorf("chunk sizes = %v, want %v", chunks, tt.wantChunks)
+			}
+			for i, tr := range result.Results {
+				if failed := tr.Err != nil; failed != tt.wantFailed[i] {
+					t.Errorf("thread %d failed = %v, want %v", i, failed, tt.wantFailed[i])
+				}
+				if tr.Applied != tt.wantApplied[i] {
+					t.Errorf("thread %d Applied = %d, want %d", i, tr.Applied, tt.wantApplied[i])
+				}
+			}
+		})
+	}
+}
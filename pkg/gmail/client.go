@@ -3,6 +3,9 @@ package gmail
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -13,25 +16,104 @@ import (
 )
 
 type Service struct {
-	api *gmail.Service
+	api     *gmail.Service
+	retry   RetryConfig
+	retries atomic.Int64
+	limiter *Limiter
+	access  Access
+	// account is the normalized email address of the authenticated account.
+	account string
+
+	labelsMu sync.Mutex
+	// labelIDs maps label IDs and lower-cased names to IDs once fetched.
+	labelIDs map[string]string
 }
 
-func NewService(ctx context.Context, httpClient option.ClientOption) (*Service, error) {
+// Config holds optional Service settings.
+type Config struct {
+	Retry RetryConfig
+	// Limiter throttles calls by quota units. Share one Limiter between all
+	// Services; when nil, each Service gets a private one with default budgets.
+	Limiter *Limiter
+	// Account is the email address of the authenticated account, e.g. from
+	// the signed-in session. It keys the account's quota budget and is
+	// returned by EmailAddress. When empty, NewService looks it up.
+	Account string
+}
+
+// lookupBudget is the quota budget charged for account lookups, whose account
+// is not yet known. It is shared by all Services using the same Limiter.
+const lookupBudget = "account-lookup"
+
+// NewService creates a Gmail client. A nil config uses the defaults. Without
+// Config.Account, the account is looked up once with Users.GetProfile, and
+// NewService fails if that is not possible.
+func NewService(ctx context.Context, httpClient option.ClientOption, config *Config) (*Service, error) {
+	if config == nil {
+		config = &Config{Retry: DefaultRetryConfig()}
+	}
+	limiter := config.Limiter
+	if limiter == nil {
+		limiter = NewLimiter(nil)
+	}
 	api, err := gmail.NewService(ctx, httpClient)
 	if err != nil {
 		return nil, fmt.Errorf("init gmail service: %w", err)
 	}
-	return &Service{api: api}, nil
+	s := &Service{
+		api:     api,
+		retry:   config.Retry.withDefaults(),
+		limiter: limiter,
+		account: NormalizeAccount(config.Account),
+	}
+	if s.account == "" {
+		var profile *gmail.Profile
+		err := s.doAs(ctx, lookupBudget, "getProfile", func() (err error) {
+			profile, err = s.api.Users.GetProfile("me").Fields("emailAddress").Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up Gmail account: %w", err)
+		}
+		s.account = NormalizeAccount(profile.EmailAddress)
+	}
+	return s, nil
+}
+
+// NormalizeAccount returns the canonical form of an account's email address,
+// as returned by EmailAddress. Records kept per account should be keyed by it.
+func NormalizeAccount(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailAddress returns the normalized email address of the authenticated
+// account.
+func (s *Service) EmailAddress() string {
+	return s.account
 }
 
 // ListCategoryThreads returns thread IDs for a given category label.
 func (s *Service) ListCategoryThreads(ctx context.Context, userID, categoryLabel string, max int64) ([]*gmail.Thread, error) {
+	return s.listThreads(ctx, userID, []string{categoryLabel}, "", max)
+}
+
+// ListThreadsByQuery returns threads matching a Gmail search query such as
+// "from:news@example.com older_than:1y". When labelIDs are given, only threads
+// carrying all of those labels are considered.
+func (s *Service) ListThreadsByQuery(ctx context.Context, userID, query string, max int64, labelIDs ...string) ([]*gmail.Thread, error) {
+	return s.listThreads(ctx, userID, labelIDs, query, max)
+}
+
+// listThreads pages through Users.Threads.List until max threads matching the
+// label and query filters have been collected or no more pages remain.
+func (s *Service) listThreads(ctx context.Context, userID string, labelIDs []string, query string, max int64) ([]*gmail.Thread, error) {
 	log := logger.L()
 	start := time.Now()
 
-	log.Info("Listing category threads with pagination",
+	log.Info("Listing threads with pagination",
 		zap.String("user_id", userID),
-		zap.String("category_label", categoryLabel),
+		zap.Strings("label_ids", labelIDs),
+		zap.String("query", query),
 		zap.Int64("max_results", max),
 	)
 
@@ -61,32 +143,57 @@ func (s *Service) ListCategoryThreads(ctx context.Context, userID, categoryLabel
 			zap.String("page_token", pageToken),
 		)
 
-		call := s.api.Users.Threads.List(userID).LabelIds(categoryLabel).MaxResults(int64(pageSize))
+		call := s.api.Users.Threads.List(userID).MaxResults(int64(pageSize))
+		if len(labelIDs) > 0 {
+			call = call.LabelIds(labelIDs...)
+		}
+		if query != "" {
+			call = call.Q(query)
+		}
 		if pageToken != "" {
 			call = call.PageToken(pageToken)
 		}
 
-		res, err := call.Context(ctx).Do()
+		var res *gmail.ListThreadsResponse
+		err := s.do(ctx, "threads.list", func() (err error) {
+			res, err = call.Context(ctx).Do()
+			return err
+		})
 		pageDuration := time.Since(pageStart)
 
 		if err != nil {
-			log.Error("Failed to list category threads page",
+			log.Error("Failed to list threads page",
 				zap.String("user_id", userID),
-				zap.String("category_label", categoryLabel),
+				zap.Strings("label_ids", labelIDs),
+				zap.String("query", query),
 				zap.Int("page_number", pageCount),
 				zap.Error(err),
 				zap.Duration("page_duration", pageDuration),
 			)
-			return nil, fmt.Errorf("failed to list category threads for %s (page %d): %w", categoryLabel, pageCount, err)
+			ReportProgress(ctx, ProgressEvent{
+				Type:      EventError,
+				Operation: "list",
+				Page:      pageCount,
+				Error:     err.Error(),
+			})
+			return nil, fmt.Errorf("failed to list threads for %s (page %d): %w", describeFilter(labelIDs, query), pageCount, err)
 		}
 
 		pageThreadCount := len(res.Threads)
 		allThreads = append(allThreads, res.Threads...)
 		totalFetched += int64(pageThreadCount)
+		ReportProgress(ctx, ProgressEvent{
+			Type:      EventPageFetched,
+			Operation: "list",
+			Page:      pageCount,
+			Done:      int(totalFetched),
+			Total:     int(max),
+		})
 
 		log.Info("Successfully fetched page",
 			zap.String("user_id", userID),
-			zap.String("category_label", categoryLabel),
+			zap.Strings("label_ids", labelIDs),
+			zap.String("query", query),
 			zap.Int("page_number", pageCount),
 			zap.Int("page_thread_count", pageThreadCount),
 			zap.Int64("total_fetched", totalFetched),
@@ -100,15 +207,13 @@ func (s *Service) ListCategoryThreads(ctx context.Context, userID, categoryLabel
 		if pageToken == "" || totalFetched >= max || pageThreadCount == 0 {
 			break
 		}
-
-		// Add a small delay between requests to respect rate limits
-		time.Sleep(200 * time.Millisecond)
 	}
 
 	totalDuration := time.Since(start)
-	log.Info("Completed category threads listing with pagination",
+	log.Info("Completed threads listing with pagination",
 		zap.String("user_id", userID),
-		zap.String("category_label", categoryLabel),
+		zap.Strings("label_ids", labelIDs),
+		zap.String("query", query),
 		zap.Int("total_pages", pageCount),
 		zap.Int64("total_threads_fetched", totalFetched),
 		zap.Int64("requested_max", max),
@@ -118,262 +223,206 @@ func (s *Service) ListCategoryThreads(ctx context.Context, userID, categoryLabel
 	return allThreads, nil
 }
 
+// describeFilter renders label and query filters for error messages.
+func describeFilter(labelIDs []string, query string) string {
+	desc := strings.Join(labelIDs, ",")
+	if query != "" {
+		if desc != "" {
+			desc += " "
+		}
+		desc += fmt.Sprintf("query %q", query)
+	}
+	return desc
+}
+
 // EstimateCategoryThreads returns the Gmail API's estimated number of threads for a label.
 func (s *Service) EstimateCategoryThreads(ctx context.Context, userID, categoryLabel string) (int64, error) {
-	call := s.api.Users.Threads.List(userID).LabelIds(categoryLabel).MaxResults(1)
-	res, err := call.Context(ctx).Do()
+	return s.estimateThreads(ctx, userID, []string{categoryLabel}, "")
+}
+
+// EstimateQueryThreads returns the Gmail API's estimated number of threads matching a search query.
+func (s *Service) EstimateQueryThreads(ctx context.Context, userID, query string, labelIDs ...string) (int64, error) {
+	return s.estimateThreads(ctx, userID, labelIDs, query)
+}
+
+func (s *Service) estimateThreads(ctx context.Context, userID string, labelIDs []string, query string) (int64, error) {
+	call := s.api.Users.Threads.List(userID).MaxResults(1)
+	if len(labelIDs) > 0 {
+		call = call.LabelIds(labelIDs...)
+	}
+	if query != "" {
+		call = call.Q(query)
+	}
+	var res *gmail.ListThreadsResponse
+	err := s.do(ctx, "threads.list", func() (err error) {
+		res, err = call.Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
 	return res.ResultSizeEstimate, nil
 }
 
-// BatchTrashThreads moves threads to trash.
-func (s *Service) BatchTrashThreads(ctx context.Context, userID string, threadIDs []string) error {
+// BatchTrashThreads moves threads to trash. Threads are expanded into their
+// messages, which are then trashed with Users.Messages.BatchModify in chunks of
+// up to 1000 IDs. The returned result reports the outcome of every thread; the
+// error is non-nil if any thread failed.
+func (s *Service) BatchTrashThreads(ctx context.Context, userID string, threadIDs []string) (*BatchResult, error) {
+	result := s.ExpandThreads(ctx, userID, threadIDs)
+	return result, s.TrashExpanded(ctx, userID, result)
+}
+
+// TrashExpanded moves the messages of the pending threads of a result of
+// ExpandThreads to trash, like BatchTrashThreads, and records the outcome in
+// result. The error is non-nil if any thread failed.
+func (s *Service) TrashExpanded(ctx context.Context, userID string, result *BatchResult) error {
 	log := logger.L()
 	start := time.Now()
+	threadCount := len(result.Results)
 
 	log.Info("Starting batch trash operation",
 		zap.String("user_id", userID),
-		zap.Int("thread_count", len(threadIDs)),
-		zap.Strings("thread_ids", threadIDs),
+		zap.Int("thread_count", threadCount),
+		zap.Int("skipped_count", len(result.Skipped())),
 	)
 
-	if len(threadIDs) == 0 {
+	if threadCount == 0 {
 		log.Info("No threads to trash, skipping operation")
 		return nil
 	}
 
-	req := &gmail.BatchModifyMessagesRequest{
-		RemoveLabelIds: []string{"INBOX"},
-		AddLabelIds:    []string{"TRASH"},
-	}
-
-	successCount := 0
-	for i, tid := range threadIDs {
-		threadStart := time.Now()
-
-		log.Debug("Processing thread for trash",
-			zap.String("user_id", userID),
-			zap.String("thread_id", tid),
-			zap.Int("thread_index", i+1),
-			zap.Int("total_threads", len(threadIDs)),
-		)
-
-		modifyReq := &gmail.ModifyThreadRequest{
-			AddLabelIds:    req.AddLabelIds,
-			RemoveLabelIds: req.RemoveLabelIds,
-		}
-
-		response, err := s.api.Users.Threads.Modify(userID, tid, modifyReq).Context(ctx).Do()
-		threadDuration := time.Since(threadStart)
-
-		if err != nil {
-			log.Error("Failed to trash thread",
-				zap.String("user_id", userID),
-				zap.String("thread_id", tid),
-				zap.Error(err),
-				zap.Duration("duration", threadDuration),
-				zap.Int("successful_before_error", successCount),
-			)
-			return fmt.Errorf("failed to trash thread %s: %w", tid, err)
-		}
-
-		successCount++
-		log.Info("Successfully trashed thread",
-			zap.String("user_id", userID),
-			zap.String("thread_id", tid),
-			zap.String("response_id", response.Id),
-			zap.Duration("duration", threadDuration),
-			zap.Int("progress", successCount),
-			zap.Int("total", len(threadIDs)),
-		)
-	}
+	s.applyToExpanded(ctx, userID, "trash", result, func(ids []string) error {
+		return s.BatchModifyMessages(ctx, userID, ids, []string{"TRASH"}, []string{"INBOX"})
+	})
 
 	totalDuration := time.Since(start)
 	log.Info("Completed batch trash operation",
 		zap.String("user_id", userID),
-		zap.Int("total_threads", len(threadIDs)),
-		zap.Int("successful_count", successCount),
+		zap.Int("total_threads", threadCount),
+		zap.Int("successful_count", len(result.Succeeded())),
+		zap.Int("failed_count", len(result.Failed())),
 		zap.Duration("total_duration", totalDuration),
-		zap.Float64("avg_duration_per_thread_ms", float64(totalDuration.Nanoseconds())/float64(len(threadIDs))/1e6),
+		zap.Float64("avg_duration_per_thread_ms", float64(totalDuration.Nanoseconds())/float64(threadCount)/1e6),
 	)
 
-	return nil
+	return result.Err()
 }
 
-// BatchDeleteThreadsPermanently permanently deletes threads.
-func (s *Service) BatchDeleteThreadsPermanently(ctx context.Context, userID string, threadIDs []string) error {
+// BatchDeleteThreadsPermanently permanently deletes threads. Threads are
+// expanded into their messages, which are then removed with
+// Users.Messages.BatchDelete in chunks of up to 1000 IDs. The returned result
+// reports the outcome of every thread; the error is non-nil if any thread failed.
+func (s *Service) BatchDeleteThreadsPermanently(ctx context.Context, userID string, threadIDs []string) (*BatchResult, error) {
+	result := s.ExpandThreads(ctx, userID, threadIDs)
+	return result, s.DeleteExpanded(ctx, userID, result)
+}
+
+// DeleteExpanded permanently deletes the messages of the pending threads of a
+// result of ExpandThreads, like BatchDeleteThreadsPermanently, and records the
+// outcome in result. The error is non-nil if any thread failed.
+func (s *Service) DeleteExpanded(ctx context.Context, userID string, result *BatchResult) error {
 	log := logger.L()
 	start := time.Now()
+	threadCount := len(result.Results)
 
 	log.Warn("Starting batch permanent delete operation - IRREVERSIBLE ACTION",
 		zap.String("user_id", userID),
-		zap.Int("thread_count", len(threadIDs)),
-		zap.Strings("thread_ids", threadIDs),
+		zap.Int("thread_count", threadCount),
+		zap.Int("skipped_count", len(result.Skipped())),
 	)
 
-	if len(threadIDs) == 0 {
+	if threadCount == 0 {
 		log.Info("No threads to permanently delete, skipping operation")
 		return nil
 	}
 
-	successCount := 0
-	for i, tid := range threadIDs {
-		threadStart := time.Now()
-
-		log.Debug("Processing thread for permanent deletion",
-			zap.String("user_id", userID),
-			zap.String("thread_id", tid),
-			zap.Int("thread_index", i+1),
-			zap.Int("total_threads", len(threadIDs)),
-		)
-
+	s.applyToExpanded(ctx, userID, "permanent_delete", result, func(ids []string) error {
 		// Log the request details before making the API call
 		log.Info("Sending permanent delete request to Gmail API",
 			zap.String("user_id", userID),
-			zap.String("thread_id", tid),
-			zap.String("api_endpoint", "Users.Threads.Delete"),
+			zap.Int("message_count", len(ids)),
+			zap.String("api_endpoint", "Users.Messages.BatchDelete"),
 			zap.String("operation_type", "PERMANENT_DELETE"),
 		)
+		return s.batchDeleteMessages(ctx, userID, ids)
+	})
 
-		err := s.api.Users.Threads.Delete(userID, tid).Context(ctx).Do()
-		threadDuration := time.Since(threadStart)
-
-		if err != nil {
-			log.Error("Failed to permanently delete thread",
-				zap.String("user_id", userID),
-				zap.String("thread_id", tid),
-				zap.Error(err),
-				zap.Duration("duration", threadDuration),
-				zap.Int("successful_before_error", successCount),
-				zap.String("error_type", "PERMANENT_DELETE_FAILED"),
-			)
-			return fmt.Errorf("failed to permanently delete thread %s: %w", tid, err)
-		}
-
-		successCount++
-		log.Warn("Successfully permanently deleted thread - IRREVERSIBLE",
+	for _, tr := range result.Failed() {
+		log.Error("Failed to permanently delete thread",
 			zap.String("user_id", userID),
-			zap.String("thread_id", tid),
-			zap.Duration("duration", threadDuration),
-			zap.Int("progress", successCount),
-			zap.Int("total", len(threadIDs)),
-			zap.String("operation_result", "PERMANENTLY_DELETED"),
-			zap.Bool("recoverable", false),
+			zap.String("thread_id", tr.ThreadID),
+			zap.Error(tr.Err),
+			zap.String("error_type", "PERMANENT_DELETE_FAILED"),
 		)
 	}
 
 	totalDuration := time.Since(start)
 	log.Warn("Completed batch permanent delete operation - ALL DELETIONS IRREVERSIBLE",
 		zap.String("user_id", userID),
-		zap.Int("total_threads", len(threadIDs)),
-		zap.Int("successful_count", successCount),
+		zap.Int("total_threads", threadCount),
+		zap.Int("successful_count", len(result.Succeeded())),
+		zap.Int("failed_count", len(result.Failed())),
 		zap.Duration("total_duration", totalDuration),
-		zap.Float64("avg_duration_per_thread_ms", float64(totalDuration.Nanoseconds())/float64(len(threadIDs))/1e6),
+		zap.Float64("avg_duration_per_thread_ms", float64(totalDuration.Nanoseconds())/float64(threadCount)/1e6),
 		zap.String("operation_summary", "PERMANENT_DELETE_BATCH_COMPLETED"),
 	)
 
-	return nil
+	return result.Err()
 }
 
-// ListTrashThreads returns thread IDs from the Trash folder.
-func (s *Service) ListTrashThreads(ctx context.Context, userID string, max int64) ([]*gmail.Thread, error) {
+// BatchModifyThreads adds and removes labels on every message of threadIDs, e.g.
+// removing INBOX to archive them or UNREAD to mark them read. Messages are
+// modified with Users.Messages.BatchModify in chunks of up to 1000 IDs. The
+// returned result reports the outcome of every thread; the error is non-nil if
+// any thread failed.
+func (s *Service) BatchModifyThreads(ctx context.Context, userID string, threadIDs, addLabelIDs, removeLabelIDs []string) (*BatchResult, error) {
+	result := s.ExpandThreads(ctx, userID, threadIDs)
+	return result, s.ModifyExpanded(ctx, userID, result, addLabelIDs, removeLabelIDs)
+}
+
+// ModifyExpanded adds and removes labels on the messages of the pending
+// threads of a result of ExpandThreads, like BatchModifyThreads, and records
+// the outcome in result. The error is non-nil if any thread failed.
+func (s *Service) ModifyExpanded(ctx context.Context, userID string, result *BatchResult, addLabelIDs, removeLabelIDs []string) error {
 	log := logger.L()
 	start := time.Now()
+	threadCount := len(result.Results)
 
-	log.Info("Listing trash threads with pagination",
+	log.Info("Starting batch modify operation",
 		zap.String("user_id", userID),
-		zap.Int64("max_results", max),
-		zap.String("label_filter", "TRASH"),
+		zap.Int("thread_count", threadCount),
+		zap.Int("skipped_count", len(result.Skipped())),
+		zap.Strings("add_label_ids", addLabelIDs),
+		zap.Strings("remove_label_ids", removeLabelIDs),
 	)
 
-	var allThreads []*gmail.Thread
-	var pageToken string
-	pageCount := 0
-	totalFetched := int64(0)
-
-	// Gmail API has a hard limit of 500 results per request
-	const maxPerPage = 500
-
-	for {
-		pageCount++
-		pageStart := time.Now()
-
-		// Calculate how many results to request for this page
-		remainingNeeded := max - totalFetched
-		pageSize := maxPerPage
-		if remainingNeeded < maxPerPage {
-			pageSize = int(remainingNeeded)
-		}
-
-		log.Debug("Fetching trash page",
-			zap.Int("page_number", pageCount),
-			zap.Int("page_size", pageSize),
-			zap.Int64("total_fetched", totalFetched),
-			zap.String("page_token", pageToken),
-		)
-
-		call := s.api.Users.Threads.List(userID).LabelIds("TRASH").MaxResults(int64(pageSize))
-		if pageToken != "" {
-			call = call.PageToken(pageToken)
-		}
-
-		res, err := call.Context(ctx).Do()
-		pageDuration := time.Since(pageStart)
-
-		if err != nil {
-			log.Error("Failed to list trash threads page",
-				zap.String("user_id", userID),
-				zap.Int("page_number", pageCount),
-				zap.Error(err),
-				zap.Duration("page_duration", pageDuration),
-			)
-			return nil, fmt.Errorf("failed to list trash threads (page %d): %w", pageCount, err)
-		}
-
-		pageThreadCount := len(res.Threads)
-		allThreads = append(allThreads, res.Threads...)
-		totalFetched += int64(pageThreadCount)
-
-		log.Info("Successfully fetched trash page",
-			zap.String("user_id", userID),
-			zap.Int("page_number", pageCount),
-			zap.Int("page_thread_count", pageThreadCount),
-			zap.Int64("total_fetched", totalFetched),
-			zap.Int64("result_size_estimate", res.ResultSizeEstimate),
-			zap.String("next_page_token", res.NextPageToken),
-			zap.Duration("page_duration", pageDuration),
-		)
-
-		// Check if we should continue pagination
-		pageToken = res.NextPageToken
-		if pageToken == "" || totalFetched >= max || pageThreadCount == 0 {
-			break
-		}
-
-		// Add a small delay between requests to respect rate limits
-		time.Sleep(200 * time.Millisecond)
+	if threadCount == 0 {
+		log.Info("No threads to modify, skipping operation")
+		return nil
 	}
 
-	totalDuration := time.Since(start)
-	log.Info("Completed trash threads listing with pagination",
+	s.applyToExpanded(ctx, userID, "modify", result, func(ids []string) error {
+		return s.BatchModifyMessages(ctx, userID, ids, addLabelIDs, removeLabelIDs)
+	})
+
+	log.Info("Completed batch modify operation",
 		zap.String("user_id", userID),
-		zap.Int("total_pages", pageCount),
-		zap.Int64("total_threads_fetched", totalFetched),
-		zap.Int64("requested_max", max),
-		zap.Duration("total_duration", totalDuration),
+		zap.Int("total_threads", threadCount),
+		zap.Int("successful_count", len(result.Succeeded())),
+		zap.Int("failed_count", len(result.Failed())),
+		zap.Duration("total_duration", time.Since(start)),
 	)
 
-	return allThreads, nil
+	return result.Err()
+}
+
+// ListTrashThreads returns thread IDs from the Trash folder.
+func (s *Service) ListTrashThreads(ctx context.Context, userID string, max int64) ([]*gmail.Thread, error) {
+	return s.listThreads(ctx, userID, []string{"TRASH"}, "", max)
 }
 
 // EstimateTrashThreads returns the Gmail API's estimated number of threads in Trash.
 func (s *Service) EstimateTrashThreads(ctx context.Context, userID string) (int64, error) {
-	call := s.api.Users.Threads.List(userID).LabelIds("TRASH").MaxResults(1)
-	res, err := call.Context(ctx).Do()
-	if err != nil {
-		return 0, err
-	}
-	return res.ResultSizeEstimate, nil
+	return s.estimateThreads(ctx, userID, []string{"TRASH"}, "")
 }
@@ -0,0 +1,201 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Sentinel errors for the kinds of Gmail API failure callers need to tell
+// apart. Errors returned by Service match one of these with errors.Is when the
+// underlying failure is a Gmail API error.
+var (
+	ErrUnauthorized      = errors.New("gmail: authentication failed")
+	ErrInsufficientScope = errors.New("gmail: insufficient OAuth scope")
+	ErrRateLimited       = errors.New("gmail: rate limit exceeded")
+	ErrNotFound          = errors.New("gmail: not found")
+	ErrQuotaExceeded     = errors.New("gmail: quota exceeded")
+	ErrServer            = errors.New("gmail: transient server error")
+
+	// ErrUnknownLabel is returned when a label name or ID does not exist in
+	// the mailbox.
+	ErrUnknownLabel = errors.New("gmail: unknown label")
+)
+
+// Machine-readable error codes, as returned by Code.
+const (
+	CodeUnauthorized      = "unauthorized"
+	CodeInsufficientScope = "insufficient_scope"
+	CodeRateLimited       = "rate_limited"
+	CodeNotFound          = "not_found"
+	CodeQuotaExceeded     = "quota_exceeded"
+	CodeServerError       = "server_error"
+	CodeUnknownLabel      = "unknown_label"
+)
+
+// APIError is a *googleapi.Error, or a failure to refresh the OAuth token,
+// classified into one of the sentinel kinds.
+type APIError struct {
+	// Kind is one of the sentinel errors above.
+	Kind       error
+	StatusCode int
+	// Reason is the first reason reported by the API, e.g. "userRateLimitExceeded".
+	Reason  string
+	Message string
+	// RetryAfter is the delay requested by the server's Retry-After header, if any.
+	RetryAfter time.Duration
+
+	err error
+}
+
+func (e *APIError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%v (HTTP %d, %s): %s", e.Kind, e.StatusCode, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("%v (HTTP %d): %s", e.Kind, e.StatusCode, e.Message)
+}
+
+// Unwrap exposes both the sentinel kind and the original error.
+func (e *APIError) Unwrap() []error {
+	return []error{e.Kind, e.err}
+}
+
+// Code returns the machine-readable code of the Gmail API error in err's
+// chain, or "" if err is not a classified Gmail API error.
+func Code(err error) string {
+	if errors.Is(err, ErrUnknownLabel) {
+		return CodeUnknownLabel
+	}
+	var accessErr *AccessError
+	if errors.As(err, &accessErr) {
+		return CodeInsufficientScope
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	switch apiErr.Kind {
+	case ErrUnauthorized:
+		return CodeUnauthorized
+	case ErrInsufficientScope:
+		return CodeInsufficientScope
+	case ErrRateLimited:
+		return CodeRateLimited
+	case ErrNotFound:
+		return CodeNotFound
+	case ErrQuotaExceeded:
+		return CodeQuotaExceeded
+	case ErrServer:
+		return CodeServerError
+	}
+	return ""
+}
+
+// classifyError converts a *googleapi.Error or *oauth2.RetrieveError into an
+// *APIError. Other errors, including unrecognised API errors, are returned
+// unchanged.
+func classifyError(err error) error {
+	var rerr *oauth2.RetrieveError
+	if err != nil && errors.As(err, &rerr) {
+		return classifyRetrieveError(rerr)
+	}
+	var gerr *googleapi.Error
+	if err == nil || !errors.As(err, &gerr) {
+		return err
+	}
+
+	reason := ""
+	if len(gerr.Errors) > 0 {
+		reason = gerr.Errors[0].Reason
+	}
+
+	var kind error
+	switch {
+	case gerr.Code == http.StatusUnauthorized:
+		kind = ErrUnauthorized
+	case gerr.Code == http.StatusNotFound:
+		kind = ErrNotFound
+	case hasReason(gerr, "dailyLimitExceeded", "quotaExceeded"):
+		kind = ErrQuotaExceeded
+	case gerr.Code == http.StatusTooManyRequests || hasReason(gerr, "rateLimitExceeded", "userRateLimitExceeded"):
+		kind = ErrRateLimited
+	case gerr.Code == http.StatusForbidden && (hasReason(gerr, "insufficientPermissions") ||
+		strings.Contains(gerr.Message, "ACCESS_TOKEN_SCOPE_INSUFFICIENT") ||
+		strings.Contains(gerr.Body, "ACCESS_TOKEN_SCOPE_INSUFFICIENT")):
+		kind = ErrInsufficientScope
+	case gerr.Code == http.StatusForbidden:
+		kind = ErrUnauthorized
+	case gerr.Code >= 500:
+		kind = ErrServer
+	default:
+		return err
+	}
+
+	return &APIError{
+		Kind:       kind,
+		StatusCode: gerr.Code,
+		Reason:     reason,
+		Message:    gerr.Message,
+		RetryAfter: retryAfter(gerr.Header),
+		err:        gerr,
+	}
+}
+
+// classifyRetrieveError classifies a failure to refresh the access token. A
+// refresh token that was revoked or expired is reported as ErrUnauthorized, so
+// that the user is asked to sign in again.
+func classifyRetrieveError(rerr *oauth2.RetrieveError) error {
+	status := http.StatusUnauthorized
+	if rerr.Response != nil {
+		status = rerr.Response.StatusCode
+	}
+	kind := ErrUnauthorized
+	if status >= 500 {
+		kind = ErrServer
+	}
+	msg := rerr.ErrorDescription
+	if msg == "" {
+		msg = "failed to refresh the OAuth token"
+	}
+	return &APIError{
+		Kind:       kind,
+		StatusCode: status,
+		Reason:     rerr.ErrorCode,
+		Message:    msg,
+		err:        rerr,
+	}
+}
+
+func hasReason(gerr *googleapi.Error, reasons ...string) bool {
+	for _, item := range gerr.Errors {
+		for _, r := range reasons {
+			if item.Reason == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func apiError(code int, reason string) *googleapi.Error {
+	gerr := &googleapi.Error{Code: code, Message: http.StatusText(code)}
+	if reason != "" {
+		gerr.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	return gerr
+}
+
+func TestClassifyError(t *testing.T) {
+	plain := errors.New("connection reset")
+	scopeBody := apiError(http.StatusForbidden, "")
+	scopeBody.Body = `{"error":{"details":[{"reason":"ACCESS_TOKEN_SCOPE_INSUFFICIENT"}]}}`
+	retryLater := apiError(http.StatusTooManyRequests, "")
+	retryLater.Header = http.Header{"Retry-After": []string{"7"}}
+
+	tests := []struct {
+		name     string
+		err      error
+		wantKind error // nil when err is returned unchanged
+		wantCode string
+		// wantRetryAfter is the expected RetryAfter of the classified error.
+		wantRetryAfter time.Duration
+	}{
+		{name: "nil", err: nil},
+		{name: "not an API error", err: plain},
+		{name: "unrecognised status", err: apiError(http.StatusBadRequest, "invalidArgument")},
+		{name: "unauthorized", err: apiError(http.StatusUnauthorized, "authError"), wantKind: ErrUnauthorized, wantCode: CodeUnauthorized},
+		{name: "not found", err: apiError(http.StatusNotFound, "notFound"), wantKind: ErrNotFound, wantCode: CodeNotFound},
+		{name: "daily limit", err: apiError(http.StatusForbidden, "dailyLimitExceeded"), wantKind: ErrQuotaExceeded, wantCode: CodeQuotaExceeded},
+		{name: "quota exceeded", err: apiError(http.StatusTooManyRequests, "quotaExceeded"), wantKind: ErrQuotaExceeded, wantCode: CodeQuotaExceeded},
+		{name: "too many requests", err: retryLater, wantKind: ErrRateLimited, wantCode: CodeRateLimited, wantRetryAfter: 7 * time.Second},
+		{name: "user rate limit", err: apiError(http.StatusForbidden, "userRateLimitExceeded"), wantKind: ErrRateLimited, wantCode: CodeRateLimited},
+		{name: "insufficient permissions", err: apiError(http.StatusForbidden, "insufficientPermissions"), wantKind: ErrInsufficientScope, wantCode: CodeInsufficientScope},
+		{name: "insufficient scope in body", err: scopeBody, wantKind: ErrInsufficientScope, wantCode: CodeInsufficientScope},
+		{name: "other forbidden", err: apiError(http.StatusForbidden, "forbidden"), wantKind: ErrUnauthorized, wantCode: CodeUnauthorized},
+		{name: "server error", err: apiError(http.StatusServiceUnavailable, "backendError"), wantKind: ErrServer, wantCode: CodeServerError},
+		{name: "wrapped", err: fmt.Errorf("list threads: %w", apiError(http.StatusNotFound, "")), wantKind: ErrNotFound, wantCode: CodeNotFound},
+		{
+			name:     "revoked refresh token",
+			err:      &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}, ErrorCode: "invalid_grant"},
+			wantKind: ErrUnauthorized,
+			wantCode: CodeUnauthorized,
+		},
+		{
+			name:     "token endpoint down",
+			err:      &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadGateway}},
+			wantKind: ErrServer,
+			wantCode: CodeServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(tt.err)
+			if tt.wantKind == nil {
+				if got != tt.err {
+					t.Fatalf("classifyError() = %v, want the error unchanged", got)
+				}
+				if code := Code(got); code != "" {
+					t.Errorf("Code() = %q, want none", code)
+				}
+				return
+			}
+
+			var apiErr *APIError
+			if !errors.As(got, &apiErr) {
+				t.Fatalf("classifyError() = %v, want an *APIError", got)
+			}
+			if !errors.Is(got, tt.wantKind) {
+				t.Errorf("classifyError() kind = %v, want %v", apiErr.Kind, tt.wantKind)
+			}
+			var gerr *googleapi.Error
+			var rerr *oauth2.RetrieveError
+			if !errors.As(got, &gerr) && !errors.As(got, &rerr) {
+				t.Errorf("classifyError() does not wrap the underlying API error")
+			}
+			if code := Code(got); code != tt.wantCode {
+				t.Errorf("Code() = %q, want %q", code, tt.wantCode)
+			}
+			if apiErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("RetryAfter = %v, want %v", apiErr.RetryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
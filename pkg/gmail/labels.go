@@ -0,0 +1,87 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ListLabels returns the system and user labels of the mailbox.
+func (s *Service) ListLabels(ctx context.Context, userID string) ([]*gmail.Label, error) {
+	var res *gmail.ListLabelsResponse
+	err := s.do(ctx, "labels.list", func() (err error) {
+		res, err = s.api.Users.Labels.List(userID).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list labels: %w", err)
+	}
+	return res.Labels, nil
+}
+
+// ResolveLabelIDs maps each of labels, given as a label ID or a label name
+// (case-insensitively), to its label ID. The mailbox's labels are fetched once
+// per Service. Unknown labels yield an error matching ErrUnknownLabel.
+func (s *Service) ResolveLabelIDs(ctx context.Context, userID string, labels []string) ([]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	s.labelsMu.Lock()
+	defer s.labelsMu.Unlock()
+	if s.labelIDs == nil {
+		list, err := s.ListLabels(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		s.labelIDs = make(map[string]string, 2*len(list))
+		for _, l := range list {
+			s.labelIDs[l.Id] = l.Id
+			s.labelIDs[strings.ToLower(l.Name)] = l.Id
+		}
+	}
+
+	ids := make([]string, 0, len(labels))
+	for _, label := range labels {
+		id, ok := s.labelIDs[label]
+		if !ok {
+			id, ok = s.labelIDs[strings.ToLower(label)]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownLabel, label)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ModifyThread adds and removes labels on every message of a single thread
+// with Users.Threads.Modify.
+func (s *Service) ModifyThread(ctx context.Context, userID, threadID string, addLabelIDs, removeLabelIDs []string) error {
+	req := &gmail.ModifyThreadRequest{
+		AddLabelIds:    addLabelIDs,
+		RemoveLabelIds: removeLabelIDs,
+	}
+	err := s.do(ctx, "threads.modify", func() error {
+		_, err := s.api.Users.Threads.Modify(userID, threadID, req).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to modify thread %s: %w", threadID, err)
+	}
+	return nil
+}
+
+// UntrashThread moves a thread out of trash with Users.Threads.Untrash.
+func (s *Service) UntrashThread(ctx context.Context, userID, threadID string) error {
+	err := s.do(ctx, "threads.untrash", func() error {
+		_, err := s.api.Users.Threads.Untrash(userID, threadID).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to untrash thread %s: %w", threadID, err)
+	}
+	return nil
+}
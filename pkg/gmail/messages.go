@@ -0,0 +1,170 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"mailcleanerpro/pkg/logger"
+)
+
+// MessageMetadata is a lightweight description of a single message.
+type MessageMetadata struct {
+	ID       string    `json:"id"`
+	ThreadID string    `json:"thread_id"`
+	From     string    `json:"from"`
+	Date     time.Time `json:"date"`
+	LabelIDs []string  `json:"label_ids"`
+	// SizeEstimate is the size of the message in bytes.
+	SizeEstimate int64 `json:"size_estimate"`
+	// ListID, ListUnsubscribe and ListUnsubscribePost are the mailing list
+	// headers of the message (RFC 2919, RFC 2369 and RFC 8058), if any.
+	ListID              string `json:"list_id,omitempty"`
+	ListUnsubscribe     string `json:"list_unsubscribe,omitempty"`
+	ListUnsubscribePost string `json:"list_unsubscribe_post,omitempty"`
+	// Subject, MessageIDHeader and DateHeader are taken from the message's
+	// Subject, Message-ID and Date headers.
+	Subject         string `json:"subject"`
+	MessageIDHeader string `json:"message_id_header,omitempty"`
+	DateHeader      string `json:"date_header,omitempty"`
+}
+
+// messageMetadataHeaders are the headers requested by GetMessageMetadata.
+var messageMetadataHeaders = []string{
+	"From", "Subject", "Date", "Message-ID",
+	"List-Id", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// GetMessageMetadata fetches the labels, size and main headers of a message,
+// including its mailing list headers, without downloading its body.
+func (s *Service) GetMessageMetadata(ctx context.Context, userID, messageID string) (*MessageMetadata, error) {
+	var msg *gmail.Message
+	err := s.do(ctx, "messages.get", func() (err error) {
+		msg, err = s.api.Users.Messages.Get(userID, messageID).
+			Format("metadata").
+			MetadataHeaders(messageMetadataHeaders...).
+			Fields(googleapi.Field("id,threadId,labelIds,sizeEstimate,internalDate,payload/headers")).
+			Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata of message %s: %w", messageID, err)
+	}
+	return &MessageMetadata{
+		ID:                  msg.Id,
+		ThreadID:            msg.ThreadId,
+		From:                header(msg, "From"),
+		Date:                time.UnixMilli(msg.InternalDate).UTC(),
+		LabelIDs:            msg.LabelIds,
+		SizeEstimate:        msg.SizeEstimate,
+		ListID:              header(msg, "List-Id"),
+		ListUnsubscribe:     header(msg, "List-Unsubscribe"),
+		ListUnsubscribePost: header(msg, "List-Unsubscribe-Post"),
+		Subject:             header(msg, "Subject"),
+		MessageIDHeader:     header(msg, "Message-ID"),
+		DateHeader:          header(msg, "Date"),
+	}, nil
+}
+
+// SendMessage sends raw, an RFC 2822 message, from the authenticated account.
+func (s *Service) SendMessage(ctx context.Context, userID string, raw []byte) error {
+	msg := &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw)}
+	err := s.do(ctx, "messages.send", func() error {
+		_, err := s.api.Users.Messages.Send(userID, msg).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	return nil
+}
+
+// ScanMessageMetadata pages through up to max messages matching query (all
+// mail when empty, including spam and trash) and passes the metadata of each
+// to fn. Messages whose metadata cannot be fetched are logged, skipped and
+// counted in the returned number; a failure to list messages ends the scan
+// with an error.
+func (s *Service) ScanMessageMetadata(ctx context.Context, userID, query string, max int64, fn func(*MessageMetadata)) (int, error) {
+	log := logger.L()
+	var pageToken string
+	pageCount := 0
+	scanned := int64(0)
+	failed := 0
+
+	// Gmail API has a hard limit of 500 results per request
+	const maxPerPage = 500
+
+	for scanned < max {
+		pageCount++
+		pageSize := int64(maxPerPage)
+		if max-scanned < pageSize {
+			pageSize = max - scanned
+		}
+
+		call := s.api.Users.Messages.List(userID).MaxResults(pageSize).IncludeSpamTrash(query == "")
+		if query != "" {
+			call = call.Q(query)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		var res *gmail.ListMessagesResponse
+		err := s.do(ctx, "messages.list", func() (err error) {
+			res, err = call.Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			ReportProgress(ctx, ProgressEvent{
+				Type:      EventError,
+				Operation: "scan",
+				Page:      pageCount,
+				Error:     err.Error(),
+			})
+			return failed, fmt.Errorf("failed to list messages for %s (page %d): %w", describeFilter(nil, query), pageCount, err)
+		}
+
+		for _, m := range res.Messages {
+			if err := ctx.Err(); err != nil {
+				return failed, err
+			}
+			meta, err := s.GetMessageMetadata(ctx, userID, m.Id)
+			scanned++
+			if err != nil {
+				log.Warn("Skipping message in scan",
+					zap.String("user_id", userID),
+					zap.String("message_id", m.Id),
+					zap.Error(err),
+				)
+				failed++
+				continue
+			}
+			fn(meta)
+		}
+		ReportProgress(ctx, ProgressEvent{
+			Type:      EventPageFetched,
+			Operation: "scan",
+			Page:      pageCount,
+			Done:      int(scanned),
+			Total:     int(max),
+		})
+
+		pageToken = res.NextPageToken
+		if pageToken == "" || len(res.Messages) == 0 {
+			break
+		}
+	}
+
+	log.Info("Completed message metadata scan",
+		zap.String("user_id", userID),
+		zap.String("query", query),
+		zap.Int("total_pages", pageCount),
+		zap.Int64("scanned_count", scanned),
+		zap.Int("failed_count", failed),
+	)
+	return failed, nil
+}
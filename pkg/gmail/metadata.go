@@ -0,0 +1,95 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// metadataHeaders are the headers requested when fetching thread metadata.
+var metadataHeaders = []string{"From", "Subject", "Date", "List-Id", "Content-Type"}
+
+// ThreadMetadata is a lightweight description of a thread, taken from its most
+// recent message.
+type ThreadMetadata struct {
+	ID           string    `json:"id"`
+	Subject      string    `json:"subject"`
+	From         string    `json:"from"`
+	Date         time.Time `json:"date"`
+	Snippet      string    `json:"snippet"`
+	LabelIDs     []string  `json:"label_ids"`
+	MessageCount int       `json:"message_count"`
+	// ListID is the List-Id header of mailing list mail.
+	ListID string `json:"list_id,omitempty"`
+	// SizeEstimate is the combined size of the thread's messages in bytes.
+	SizeEstimate int64 `json:"size_estimate"`
+	// HasAttachment reports whether any message is multipart/mixed, which is
+	// how attachments are sent. Message bodies are not inspected.
+	HasAttachment bool `json:"has_attachment"`
+}
+
+// GetThreadMetadata fetches the headers of a thread without downloading message bodies.
+func (s *Service) GetThreadMetadata(ctx context.Context, userID, threadID string) (*ThreadMetadata, error) {
+	var thread *gmail.Thread
+	err := s.do(ctx, "threads.get", func() (err error) {
+		thread, err = s.api.Users.Threads.Get(userID, threadID).
+			Format("metadata").
+			MetadataHeaders(metadataHeaders...).
+			Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata of thread %s: %w", threadID, err)
+	}
+
+	meta := &ThreadMetadata{
+		ID:           thread.Id,
+		Snippet:      thread.Snippet,
+		MessageCount: len(thread.Messages),
+	}
+	if len(thread.Messages) == 0 {
+		return meta, nil
+	}
+
+	labels := make(map[string]bool)
+	for _, m := range thread.Messages {
+		for _, l := range m.LabelIds {
+			if !labels[l] {
+				labels[l] = true
+				meta.LabelIDs = append(meta.LabelIDs, l)
+			}
+		}
+		meta.SizeEstimate += m.SizeEstimate
+		if strings.HasPrefix(strings.ToLower(header(m, "Content-Type")), "multipart/mixed") {
+			meta.HasAttachment = true
+		}
+		if listID := header(m, "List-Id"); listID != "" {
+			meta.ListID = listID
+		}
+	}
+
+	latest := thread.Messages[len(thread.Messages)-1]
+	meta.Subject = header(latest, "Subject")
+	meta.From = header(latest, "From")
+	meta.Date = time.UnixMilli(latest.InternalDate).UTC()
+	if meta.Snippet == "" {
+		meta.Snippet = latest.Snippet
+	}
+	return meta, nil
+}
+
+// header returns the value of the named header of m, or "" if it is absent.
+func header(m *gmail.Message, name string) string {
+	if m.Payload == nil {
+		return ""
+	}
+	for _, h := range m.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
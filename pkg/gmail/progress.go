@@ -0,0 +1,69 @@
+package gmail
+
+import (
+	"context"
+	"time"
+)
+
+// EventType identifies the kind of a ProgressEvent.
+type EventType string
+
+const (
+	// EventSelectionStarted is sent when a category or query starts being processed.
+	// Done is the index of the selection and Total the number of selections.
+	EventSelectionStarted EventType = "selection_started"
+	// EventPageFetched is sent after each page of a listing.
+	// Done is the number of threads fetched so far and Total the requested maximum.
+	EventPageFetched EventType = "page_fetched"
+	// EventBatchProgress is sent after each batch request.
+	// Done is the number of threads processed so far and Total the batch size.
+	EventBatchProgress EventType = "batch_progress"
+	// EventSelectionFinished is sent when a selection has been processed.
+	// Done is the number of threads cleaned and Total the number selected.
+	EventSelectionFinished EventType = "selection_finished"
+	// EventRetry is sent before a failed call is retried.
+	// Done is the attempt that failed and Total the maximum number of attempts.
+	EventRetry EventType = "retry"
+	// EventError is sent when an operation fails.
+	EventError EventType = "error"
+)
+
+// ProgressEvent describes a step of a long-running operation.
+type ProgressEvent struct {
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	Selection string    `json:"selection,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	Page      int       `json:"page,omitempty"`
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ProgressFunc receives progress events. It is called synchronously from the
+// goroutines doing the work, possibly several at once, so it must be safe for
+// concurrent use and must not block.
+type ProgressFunc func(ProgressEvent)
+
+type progressKey struct{}
+
+// WithProgress returns a context whose Gmail calls report progress to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// ProgressFrom returns the ProgressFunc attached to ctx, or nil.
+func ProgressFrom(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// ReportProgress sends e to the ProgressFunc attached to ctx, if any.
+func ReportProgress(ctx context.Context, e ProgressEvent) {
+	if fn := ProgressFrom(ctx); fn != nil {
+		if e.Time.IsZero() {
+			e.Time = time.Now().UTC()
+		}
+		fn(e)
+	}
+}
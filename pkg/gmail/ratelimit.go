@@ -0,0 +1,195 @@
+package gmail
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// quotaCosts are the Gmail API quota units charged per call, as documented at
+// https://developers.google.com/gmail/api/reference/quota.
+var quotaCosts = map[string]int{
+	"getProfile":               1,
+	"labels.list":              1,
+	"labels.get":               1,
+	"labels.create":            5,
+	"messages.list":            5,
+	"messages.get":             5,
+	"messages.attachments.get": 5,
+	"messages.modify":          5,
+	"messages.trash":           5,
+	"messages.untrash":         5,
+	"messages.delete":          10,
+	"messages.insert":          25,
+	"messages.batchModify":     50,
+	"messages.batchDelete":     50,
+	"messages.send":            100,
+	"threads.list":             10,
+	"threads.get":              10,
+	"threads.modify":           10,
+	"threads.trash":            10,
+	"threads.untrash":          10,
+	"threads.delete":           20,
+}
+
+// defaultQuotaCost is charged for operations missing from quotaCosts.
+const defaultQuotaCost = 10
+
+// quotaCost returns the quota units charged for operation.
+func quotaCost(operation string) int {
+	if n, ok := quotaCosts[operation]; ok {
+		return n
+	}
+	return defaultQuotaCost
+}
+
+// RateLimitConfig sets the quota-unit budgets enforced by a Limiter.
+type RateLimitConfig struct {
+	// UserUnitsPerSecond is the budget of each Gmail account.
+	UserUnitsPerSecond float64
+	// ProjectUnitsPerSecond is the budget shared by all accounts using the
+	// OAuth client.
+	ProjectUnitsPerSecond float64
+}
+
+// DefaultRateLimitConfig returns Gmail's published per-user and per-project
+// limits of 250 and 20,000 quota units per second.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		UserUnitsPerSecond:    250,
+		ProjectUnitsPerSecond: 20000,
+	}
+}
+
+func (c RateLimitConfig) withDefaults() RateLimitConfig {
+	d := DefaultRateLimitConfig()
+	if c.UserUnitsPerSecond <= 0 {
+		c.UserUnitsPerSecond = d.UserUnitsPerSecond
+	}
+	if c.ProjectUnitsPerSecond <= 0 {
+		c.ProjectUnitsPerSecond = d.ProjectUnitsPerSecond
+	}
+	return c
+}
+
+// userBucketIdleTimeout is how long an account's bucket is kept after its last
+// use. An idle bucket is full, so dropping it loses nothing.
+const userBucketIdleTimeout = 10 * time.Minute
+
+// Limiter throttles Gmail API calls by quota units using token buckets: one per
+// account and one for the whole project. A single Limiter should be shared by
+// all Services so that concurrent requests for the same account draw from the
+// same budget.
+type Limiter struct {
+	config  RateLimitConfig
+	project *tokenBucket
+
+	mu    sync.Mutex
+	users map[string]*tokenBucket
+}
+
+// NewLimiter creates a Limiter. A nil config uses the defaults.
+func NewLimiter(config *RateLimitConfig) *Limiter {
+	if config == nil {
+		config = &RateLimitConfig{}
+	}
+	c := config.withDefaults()
+	return &Limiter{
+		config:  c,
+		project: newTokenBucket(c.ProjectUnitsPerSecond),
+		users:   make(map[string]*tokenBucket),
+	}
+}
+
+// Wait blocks until units quota units are available to account and the
+// project, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, account string, units int) error {
+	now := time.Now()
+	user := l.userBucket(account, now)
+
+	delay := user.reserve(units, now)
+	if d := l.project.reserve(units, now); d > delay {
+		delay = d
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		user.release(units)
+		l.project.release(units)
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *Limiter) userBucket(account string, now time.Time) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.users[account]; ok {
+		return b
+	}
+	for key, b := range l.users {
+		if b.idleSince(now) > userBucketIdleTimeout {
+			delete(l.users, key)
+		}
+	}
+	b := newTokenBucket(l.config.UserUnitsPerSecond)
+	l.users[account] = b
+	return b
+}
+
+// tokenBucket holds up to one second's worth of quota units. Reservations may
+// drive the balance negative, which makes later callers queue behind earlier
+// ones instead of racing for refilled tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// reserve takes units from the bucket and returns how long the caller must
+// wait before using them.
+func (b *tokenBucket) reserve(units int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	b.tokens -= float64(units)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// release returns units reserved by a caller that gave up waiting.
+func (b *tokenBucket) release(units int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(units)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last)
+}
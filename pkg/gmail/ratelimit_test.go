@@ -0,0 +1,97 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type limiterCall struct {
+	account string
+	units   int
+}
+
+func TestLimiterWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RateLimitConfig
+		// before are drawn from the buckets before the timed call.
+		before []limiterCall
+		call   limiterCall
+		// wantMin and wantMax bound how long the timed call blocks.
+		wantMin, wantMax time.Duration
+	}{
+		{
+			name:    "within budget",
+			config:  RateLimitConfig{UserUnitsPerSecond: 100, ProjectUnitsPerSecond: 1000},
+			call:    limiterCall{"a@example.com", 50},
+			wantMax: 20 * time.Millisecond,
+		},
+		{
+			name:    "user budget exhausted",
+			config:  RateLimitConfig{UserUnitsPerSecond: 100, ProjectUnitsPerSecond: 1000},
+			before:  []limiterCall{{"a@example.com", 100}},
+			call:    limiterCall{"a@example.com", 20},
+			wantMin: 150 * time.Millisecond,
+			wantMax: 400 * time.Millisecond,
+		},
+		{
+			name:    "accounts have separate budgets",
+			config:  RateLimitConfig{UserUnitsPerSecond: 100, ProjectUnitsPerSecond: 1000},
+			before:  []limiterCall{{"a@example.com", 100}},
+			call:    limiterCall{"b@example.com", 100},
+			wantMax: 20 * time.Millisecond,
+		},
+		{
+			name:    "project budget exhausted",
+			config:  RateLimitConfig{UserUnitsPerSecond: 1000, ProjectUnitsPerSecond: 100},
+			before:  []limiterCall{{"a@example.com", 100}},
+			call:    limiterCall{"b@example.com", 20},
+			wantMin: 150 * time.Millisecond,
+			wantMax: 400 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(&tt.config)
+			ctx := context.Background()
+			for _, c := range tt.before {
+				if err := l.Wait(ctx, c.account, c.units); err != nil {
+					t.Fatalf("Wait(%q, %d) = %v", c.account, c.units, err)
+				}
+			}
+
+			start := time.Now()
+			if err := l.Wait(ctx, tt.call.account, tt.call.units); err != nil {
+				t.Fatalf("Wait(%q, %d) = %v", tt.call.account, tt.call.units, err)
+			}
+			if d := time.Since(start); d < tt.wantMin || d > tt.wantMax {
+				t.Errorf("Wait blocked for %v, want between %v and %v", d, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := NewLimiter(&RateLimitConfig{UserUnitsPerSecond: 10, ProjectUnitsPerSecond: 1000})
+	if err := l.Wait(context.Background(), "a@example.com", 10); err != nil {
+		t.Fatalf("Wait = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, "a@example.com", 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with expiring context = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The abandoned reservation is returned, so the next caller only waits
+	// for the first call's units to refill, not for both.
+	start := time.Now()
+	if err := l.Wait(context.Background(), "a@example.com", 1); err != nil {
+		t.Fatalf("Wait = %v", err)
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("Wait after cancellation blocked for %v, want at most 300ms", d)
+	}
+}
@@ -0,0 +1,73 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// RawMessage is a message in RFC 2822 form, as stored by Gmail.
+type RawMessage struct {
+	ID       string
+	ThreadID string
+	// InternalDate is when Gmail received the message.
+	InternalDate time.Time
+	Raw          []byte
+}
+
+// GetRawMessage downloads a single message in RFC 2822 form (format=RAW).
+func (s *Service) GetRawMessage(ctx context.Context, userID, messageID string) (*RawMessage, error) {
+	var msg *gmail.Message
+	err := s.do(ctx, "messages.get", func() (err error) {
+		msg, err = s.api.Users.Messages.Get(userID, messageID).
+			Format("raw").
+			Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch raw message %s: %w", messageID, err)
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		// Gmail normally pads the encoding, but accept unpadded data too.
+		if raw, err = base64.RawURLEncoding.DecodeString(msg.Raw); err != nil {
+			return nil, fmt.Errorf("failed to decode raw message %s: %w", messageID, err)
+		}
+	}
+	return &RawMessage{
+		ID:           msg.Id,
+		ThreadID:     msg.ThreadId,
+		InternalDate: time.UnixMilli(msg.InternalDate).UTC(),
+		Raw:          raw,
+	}, nil
+}
+
+// GetRawThread downloads every message of a thread in RFC 2822 form, oldest first.
+func (s *Service) GetRawThread(ctx context.Context, userID, threadID string) ([]*RawMessage, error) {
+	var thread *gmail.Thread
+	err := s.do(ctx, "threads.get", func() (err error) {
+		thread, err = s.api.Users.Threads.Get(userID, threadID).
+			Format("minimal").
+			Fields(googleapi.Field("id"), googleapi.Field("messages/id")).
+			Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages of thread %s: %w", threadID, err)
+	}
+
+	msgs := make([]*RawMessage, 0, len(thread.Messages))
+	for _, m := range thread.Messages {
+		raw, err := s.GetRawMessage(ctx, userID, m.Id)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, raw)
+	}
+	return msgs, nil
+}
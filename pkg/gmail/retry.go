@@ -0,0 +1,145 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mailcleanerpro/pkg/logger"
+)
+
+// RetryConfig controls how failed Gmail API calls are retried.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts per call, including the first.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, except when the server asks
+	// for a longer one with Retry-After.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the delay grows by after each attempt.
+	Multiplier float64
+	// Jitter randomises each delay by up to this fraction in either direction.
+	Jitter float64
+}
+
+// DefaultRetryConfig returns the retry settings used when none are configured.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     32 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+}
+
+// withDefaults fills unset fields from DefaultRetryConfig. A zero Jitter is
+// kept, as it is a valid setting.
+func (c RetryConfig) withDefaults() RetryConfig {
+	d := DefaultRetryConfig()
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = d.MaxAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = d.InitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = d.MaxBackoff
+	}
+	if c.Multiplier < 1 {
+		c.Multiplier = d.Multiplier
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		c.Jitter = d.Jitter
+	}
+	return c
+}
+
+// backoff returns the delay before retry number attempt (starting at 1).
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	d := float64(c.InitialBackoff) * math.Pow(c.Multiplier, float64(attempt-1))
+	if d > float64(c.MaxBackoff) {
+		d = float64(c.MaxBackoff)
+	}
+	if c.Jitter > 0 {
+		d *= 1 + c.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// IsRetryable reports whether err is a transient failure worth retrying:
+// rate limiting, Gmail server errors and network timeouts. Authentication,
+// scope, not-found and daily quota errors are fatal.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServer) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// do runs call, retrying transient failures with exponential backoff and
+// jitter. A Retry-After delay requested by the server takes precedence over
+// the computed backoff when it is longer. Every attempt first waits for the
+// operation's quota cost in the Limiter. The returned error is classified.
+func (s *Service) do(ctx context.Context, operation string, call func() error) error {
+	return s.doAs(ctx, s.account, operation, call)
+}
+
+// doAs is do, charging quota to account's budget.
+func (s *Service) doAs(ctx context.Context, account, operation string, call func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err := s.limiter.Wait(ctx, account, quotaCost(operation)); err != nil {
+			return err
+		}
+		err = classifyError(call())
+		if err == nil || !IsRetryable(err) || attempt >= s.retry.MaxAttempts {
+			return err
+		}
+
+		delay := s.retry.backoff(attempt)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+
+		s.retries.Add(1)
+		logger.L().Warn("Retrying Gmail API call",
+			zap.String("operation", operation),
+			zap.Int("attempt", attempt),
+			zap.Int("max_attempts", s.retry.MaxAttempts),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		ReportProgress(ctx, ProgressEvent{
+			Type:      EventRetry,
+			Operation: operation,
+			Done:      attempt,
+			Total:     s.retry.MaxAttempts,
+			Error:     err.Error(),
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Retries returns the number of retried Gmail API calls made by s so far.
+func (s *Service) Retries() int64 {
+	return s.retries.Load()
+}